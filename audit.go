@@ -0,0 +1,348 @@
+package mdocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Audit log defaults
+const (
+	DefaultAuditMaxSize    = 100 // MB
+	DefaultAuditMaxBackups = 5
+)
+
+// redacted replaces the values of sensitive params in the audit log
+const redacted = "[REDACTED]"
+
+// sensitiveParams are the lowercased names of params whose values are
+// redacted. Env is included since environment variables commonly hold
+// secrets.
+var sensitiveParams = map[string]bool{
+	"password":      true,
+	"passphrase":    true,
+	"secret":        true,
+	"token":         true,
+	"identitytoken": true,
+	"registrytoken": true,
+	"credential":    true,
+	"credentials":   true,
+	"auth":          true,
+	"authorization": true,
+	"apikey":        true,
+	"privatekey":    true,
+	"env":           true,
+}
+
+type (
+	// AuditConfig configures the audit log of mutating RPC calls
+	AuditConfig struct {
+		// Path is the audit log file. The audit log is disabled if empty.
+		Path string `yaml:"path"`
+		// MaxSize is the size in MB at which the file is rotated
+		MaxSize uint `yaml:"maxSize"`
+		// MaxBackups is the number of rotated files to keep
+		MaxBackups uint `yaml:"maxBackups"`
+	}
+
+	// AuditEntry is a line of the audit log
+	AuditEntry struct {
+		Time       time.Time       `json:"time"`
+		RequestID  string          `json:"requestId,omitempty"`
+		Caller     string          `json:"caller,omitempty"`
+		RemoteAddr string          `json:"remoteAddr"`
+		Method     string          `json:"method"`
+		Guest      string          `json:"guest,omitempty"`
+		Image      string          `json:"image,omitempty"`
+		Params     json.RawMessage `json:"params,omitempty"`
+		Outcome    string          `json:"outcome"`
+		ErrorCode  ErrorCode       `json:"errorCode,omitempty"`
+		Error      string          `json:"error,omitempty"`
+		// Duration is in seconds
+		Duration float64 `json:"duration"`
+	}
+
+	// auditLog appends entries to a JSON lines file, rotating it when it
+	// grows past the maximum size
+	auditLog struct {
+		mutex      sync.Mutex
+		path       string
+		maxSize    int64
+		maxBackups int
+		file       *os.File
+		size       int64
+	}
+
+	// auditCall collects the details of an audited request as it is
+	// handled. Nothing is recorded for requests that never get a method.
+	auditCall struct {
+		method string
+		caller string
+		params json.RawMessage
+		err    error
+		denied bool
+	}
+
+	// auditCallKey is the context key for the auditCall of a request
+	auditCallKey struct{}
+)
+
+// errNotDispatched is recorded for RPC calls the rpc server rejected before
+// dispatching them, e.g. for an unknown method
+var errNotDispatched = errors.New("rpc: call not dispatched")
+
+// Validate checks the audit log settings
+func (c AuditConfig) Validate() error {
+	if c.Path != "" && c.MaxSize == 0 {
+		return fmt.Errorf("audit log max size must be positive")
+	}
+	return nil
+}
+
+// newAuditLog opens an audit log for appending
+func newAuditLog(config AuditConfig) (*auditLog, error) {
+	a := &auditLog{
+		path:       config.Path,
+		maxSize:    int64(config.MaxSize) * 1024 * 1024, // Convert MB to bytes
+		maxBackups: int(config.MaxBackups),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the current log file. The mutex must be held.
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// backupPath returns the path of the nth rotated file
+func (a *auditLog) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", a.path, n)
+}
+
+// rotate moves the current file to the first backup, shifting the existing
+// backups and dropping the oldest. The mutex must be held.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+	for n := a.maxBackups - 1; n > 0; n-- {
+		if err := os.Rename(a.backupPath(n), a.backupPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.backupPath(1)); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// write appends an entry to the log
+func (a *auditLog) write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// close closes the log file
+func (a *auditLog) close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// isMutatingMethod reports whether an RPC method changes anything, which is
+// anything other than listing or getting
+func isMutatingMethod(method string) bool {
+	name := strings.TrimPrefix(method, "MDocker.")
+	return !strings.HasPrefix(name, "List") && !strings.HasPrefix(name, "Get")
+}
+
+// redact replaces the values of sensitive fields in decoded JSON
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if sensitiveParams[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i, field := range v {
+			v[i] = redact(field)
+		}
+	}
+	return value
+}
+
+// auditParams extracts the guest or image id from an RPC call's params and
+// redacts them for the audit log
+func auditParams(method string, raw json.RawMessage, entry *AuditEntry) {
+	var params []interface{}
+	if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 {
+		entry.Params = raw
+		return
+	}
+
+	if request, ok := params[0].(map[string]interface{}); ok {
+		id, _ := request["id"].(string)
+		if guest, ok := request["guest"].(map[string]interface{}); ok {
+			if guestID, _ := guest["id"].(string); guestID != "" {
+				id = guestID
+			}
+		}
+		if strings.Contains(method, "Image") {
+			entry.Image = id
+		} else {
+			entry.Guest = id
+		}
+	}
+
+	redactedParams, err := json.Marshal(redact(params))
+	if err != nil {
+		return
+	}
+	entry.Params = redactedParams
+}
+
+// auditCallFrom returns the audit record of a request, or nil if it isn't
+// being audited
+func auditCallFrom(ctx context.Context) *auditCall {
+	call, _ := ctx.Value(auditCallKey{}).(*auditCall)
+	return call
+}
+
+// auditFailed records the error of an audited request that failed outside of
+// an RPC method
+func auditFailed(ctx context.Context, err error) {
+	if call := auditCallFrom(ctx); call != nil {
+		call.err = err
+	}
+}
+
+// auditDenied records an audited request rejected by the authorization
+// policy
+func auditDenied(ctx context.Context, err error) {
+	if call := auditCallFrom(ctx); call != nil {
+		call.err = err
+		call.denied = true
+	}
+}
+
+// auditRequests wraps the server's handler, writing an audit log entry for
+// each mutating call once it has been handled, whether or not the response
+// could be written
+func (md *MDocker) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if md.audit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		call := &auditCall{}
+		start := time.Now()
+		defer md.auditRecord(r, call, start)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditCallKey{}, call)))
+	})
+}
+
+// auditConsole wraps the console handler, naming the audited session after
+// whether it attaches to the container or runs a command
+func auditConsole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if call := auditCallFrom(r.Context()); call != nil {
+			request := map[string]interface{}{"id": mux.Vars(r)["id"]}
+			call.method = "ConsoleAttach"
+			if cmd := r.URL.Query()["cmd"]; len(cmd) > 0 {
+				call.method = "ConsoleExec"
+				request["cmd"] = cmd
+			}
+			call.params, _ = json.Marshal([]interface{}{request})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auditRecord writes the audit log entry of a mutating call
+func (md *MDocker) auditRecord(r *http.Request, call *auditCall, start time.Time) {
+	if call.method == "" || !isMutatingMethod(call.method) {
+		return
+	}
+	// Without an authorization policy, a client certificate still identifies
+	// the caller
+	caller := call.caller
+	if caller == "" && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		caller = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	entry := &AuditEntry{
+		Time:       start,
+		RequestID:  requestID(r.Context()),
+		Caller:     caller,
+		RemoteAddr: r.RemoteAddr,
+		Method:     call.method,
+		Outcome:    "success",
+		Duration:   time.Since(start).Seconds(),
+	}
+	if call.params != nil {
+		auditParams(call.method, call.params, entry)
+	}
+	if call.err != nil {
+		rpcErr := newRPCError(call.err)
+		entry.Outcome = "error"
+		if call.denied {
+			entry.Outcome = "denied"
+		}
+		entry.ErrorCode = rpcErr.Code
+		entry.Error = rpcErr.Message
+	}
+
+	if err := md.audit.write(entry); err != nil {
+		logger(r.Context()).WithFields(log.Fields{
+			"error":  err,
+			"method": call.method,
+			"file":   md.audit.path,
+		}).Error("failed to write audit log entry")
+	}
+}
@@ -0,0 +1,280 @@
+package mdocker_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type AuditTestSuite struct {
+	APITestSuite
+	AuditDir     string
+	AuditMDocker *mdocker.MDocker
+	AuditPort    int
+	AuditClient  *rpc.Client
+	AuditServer  *graceful.Server
+}
+
+func TestAuditTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditTestSuite))
+}
+
+func (s *AuditTestSuite) SetupSuite() {
+	s.APITestSuite.SetupSuite()
+
+	var err error
+	s.AuditDir, err = ioutil.TempDir("", "mdocker-audit")
+	s.Require().NoError(err)
+
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.Audit.Path = filepath.Join(s.AuditDir, "audit.log")
+	s.AuditMDocker, err = mdocker.NewWithConfig(config)
+	s.Require().NoError(err)
+
+	s.AuditPort = s.Port + 3
+	s.AuditServer, err = s.AuditMDocker.RunHTTP(uint(s.AuditPort))
+	s.Require().NoError(err)
+	s.AuditClient, _ = rpc.NewClient(uint(s.AuditPort), "")
+	time.Sleep(200 * time.Millisecond)
+}
+
+func (s *AuditTestSuite) TearDownSuite() {
+	stopChan := s.AuditServer.StopChan()
+	s.AuditServer.Stop(5 * time.Second)
+	<-stopChan
+	s.AuditMDocker.Close()
+	_ = os.RemoveAll(s.AuditDir)
+
+	s.APITestSuite.TearDownSuite()
+}
+
+// auditEntries reads the audit log
+func (s *AuditTestSuite) auditEntries() []*mdocker.AuditEntry {
+	return s.readAuditEntries(filepath.Join(s.AuditDir, "audit.log"))
+}
+
+// readAuditEntries reads an audit log file
+func (s *AuditTestSuite) readAuditEntries(path string) []*mdocker.AuditEntry {
+	file, err := os.Open(path)
+	s.Require().NoError(err)
+	defer func() { _ = file.Close() }()
+
+	var entries []*mdocker.AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &mdocker.AuditEntry{}
+		s.Require().NoError(json.Unmarshal(scanner.Bytes(), entry))
+		entries = append(entries, entry)
+	}
+	s.Require().NoError(scanner.Err())
+	return entries
+}
+
+func (s *AuditTestSuite) TestAuditLog() {
+	before := len(s.auditEntries())
+	guestID := uuid.New()
+	request := &rpc.GuestRequest{Guest: &client.Guest{ID: guestID}}
+
+	// Reads aren't audited
+	s.Error(s.AuditClient.Do("MDocker.GetGuest", request, &rpc.GuestResponse{}))
+	// A mutating call that fails
+	s.Error(s.AuditClient.Do("MDocker.StopContainer", request, &rpc.GuestResponse{}))
+	// Sensitive params are redacted
+	execRequest := &mdocker.ExecRequest{
+		ID:  guestID,
+		Cmd: []string{"ls"},
+		Env: []string{"PASSWORD=hunter2"},
+	}
+	s.Error(s.AuditClient.Do("MDocker.ExecContainer", execRequest, &mdocker.ExecResponse{}))
+	// Only params with sensitive names are redacted, not ones that merely
+	// contain a sensitive word
+	createRequest := &rpc.GuestRequest{Guest: &client.Guest{
+		ID: uuid.New(),
+		Metadata: map[string]string{
+			"author":   "alice",
+			"password": "hunter3",
+		},
+	}}
+	s.Error(s.AuditClient.Do("MDocker.CreateContainer", createRequest, &rpc.GuestResponse{}))
+
+	entries := s.auditEntries()[before:]
+	s.Require().Len(entries, 3, "should only audit mutating calls")
+
+	stop := entries[0]
+	s.Equal("MDocker.StopContainer", stop.Method)
+	s.Equal(guestID, stop.Guest, "should record the guest id")
+	s.Equal("error", stop.Outcome)
+	s.Equal(mdocker.ErrorCodeNotFound, stop.ErrorCode)
+	s.NotEmpty(stop.RemoteAddr)
+
+	exec := entries[1]
+	s.Equal("MDocker.ExecContainer", exec.Method)
+	s.NotContains(string(exec.Params), "hunter2", "should redact sensitive params")
+	s.Contains(string(exec.Params), `"ls"`, "should keep other params")
+
+	create := entries[2]
+	s.NotContains(string(create.Params), "hunter3", "should redact sensitive params")
+	s.Contains(string(create.Params), `"alice"`, "should keep params with other names")
+}
+
+func (s *AuditTestSuite) TestAuditConfigValidate() {
+	config := mdocker.DefaultConfig()
+	config.Audit.Path = "/var/log/mdocker/audit.log"
+	s.NoError(config.Validate())
+	config.Audit.MaxSize = 0
+	s.Error(config.Validate(), "should require a max size")
+}
+
+func (s *AuditTestSuite) TestAuditDenied() {
+	policy := &mdocker.AuthPolicy{
+		Users: []*mdocker.AuthUser{
+			{Name: "reader", Token: "read-token", Role: mdocker.RoleReadOnly},
+		},
+	}
+	port := s.Port + 4
+	server, err := s.AuditMDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		Port: uint(port),
+		Auth: policy,
+	})
+	s.Require().NoError(err)
+	defer func() {
+		stopChan := server.StopChan()
+		server.Stop(5 * time.Second)
+		<-stopChan
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	before := len(s.auditEntries())
+	guestID := uuid.New()
+	body, err := json.Marshal(map[string]interface{}{
+		"method": "MDocker.DeleteContainer",
+		"params": []interface{}{&rpc.ContainerRequest{ID: guestID}},
+		"id":     0,
+	})
+	s.Require().NoError(err)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", port, rpc.RPCPath), bytes.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer read-token")
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	entries := s.auditEntries()[before:]
+	s.Require().Len(entries, 1, "should audit the denied call")
+	denied := entries[0]
+	s.Equal("MDocker.DeleteContainer", denied.Method)
+	s.Equal("reader", denied.Caller, "should record the caller")
+	s.Equal(guestID, denied.Guest, "should record the guest id")
+	s.Equal("denied", denied.Outcome)
+	s.Equal(mdocker.ErrorCodeUnauthorized, denied.ErrorCode)
+}
+
+func (s *AuditTestSuite) TestAuditConsole() {
+	guestID := uuid.New()
+	tests := []struct {
+		description string
+		query       string
+		method      string
+	}{
+		{"attach", "", "ConsoleAttach"},
+		{"exec", "?cmd=ls", "ConsoleExec"},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		before := len(s.auditEntries())
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/containers/%s/console%s", s.AuditPort, guestID, test.query))
+		s.Require().NoError(err, msg("request failed"))
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+		entries := s.auditEntries()[before:]
+		s.Require().Len(entries, 1, msg("should audit the console session"))
+		s.Equal(test.method, entries[0].Method, msg("unexpected method"))
+		s.Equal(guestID, entries[0].Guest, msg("should record the guest id"))
+		s.Equal("error", entries[0].Outcome, msg("unexpected outcome"))
+		s.Equal(mdocker.ErrorCodeNotFound, entries[0].ErrorCode, msg("unexpected error code"))
+		if test.query != "" {
+			s.Contains(string(entries[0].Params), `"ls"`, msg("should record the command"))
+		}
+	}
+}
+
+func (s *AuditTestSuite) TestAuditRotation() {
+	dir, err := ioutil.TempDir("", "mdocker-audit-rotation")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.Audit.Path = filepath.Join(dir, "audit.log")
+	config.Audit.MaxSize = 1
+	config.Audit.MaxBackups = 2
+	port := s.Port + 5
+
+	// The size limit is in MB, so fill the file nearly to it between runs.
+	// Each run starts a new agent, since it tracks the size it has written.
+	fill := func(round int) {
+		file, err := os.OpenFile(config.Audit.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		s.Require().NoError(err)
+		padding := strings.Repeat("x", 1024*1024-20)
+		_, err = fmt.Fprintf(file, "round-%d %s\n", round, padding)
+		s.Require().NoError(err)
+		s.Require().NoError(file.Close())
+	}
+	mutate := func() {
+		md, err := mdocker.NewWithConfig(config)
+		s.Require().NoError(err)
+		server, err := md.RunHTTP(uint(port))
+		s.Require().NoError(err)
+		time.Sleep(200 * time.Millisecond)
+		rpcClient, _ := rpc.NewClient(uint(port), "")
+		request := &rpc.GuestRequest{Guest: &client.Guest{ID: uuid.New()}}
+		s.Error(rpcClient.Do("MDocker.StopContainer", request, &rpc.GuestResponse{}))
+		stopChan := server.StopChan()
+		server.Stop(5 * time.Second)
+		<-stopChan
+		md.Close()
+	}
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		s.Require().NoError(err)
+		return string(data)
+	}
+
+	for round := 1; round <= 3; round++ {
+		fill(round)
+		mutate()
+
+		entries := s.readAuditEntries(config.Audit.Path)
+		s.Len(entries, 1, "round %d: should start a new file with the entry", round)
+		s.Contains(read(config.Audit.Path+".1"), fmt.Sprintf("round-%d ", round), "round %d: should move the full file to .1", round)
+		if round > 1 {
+			s.Contains(read(config.Audit.Path+".2"), fmt.Sprintf("round-%d ", round-1), "round %d: should shift .1 to .2", round)
+		}
+		if round > 2 {
+			s.NotContains(read(config.Audit.Path+".2"), fmt.Sprintf("round-%d ", round-2), "round %d: should drop the oldest backup", round)
+		}
+		s.Empty(read(config.Audit.Path+".3"), "round %d: should drop backups past the max", round)
+	}
+}
@@ -0,0 +1,293 @@
+package mdocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// Roles, from least to most privileged. Each role may do everything the
+// roles before it may.
+const (
+	RoleReadOnly Role = "read-only"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+type (
+	// Role is a level of access to the RPC methods
+	Role string
+
+	// AuthUser is a caller known to the authorization policy. Callers are
+	// identified by bearer token if they send one, or otherwise by the
+	// common name of their tls client certificate.
+	AuthUser struct {
+		Name  string `json:"name"`
+		Token string `json:"token,omitempty"`
+		Role  Role   `json:"role"`
+	}
+
+	// AuthPolicy maps callers to roles and, optionally, overrides the role
+	// required for specific methods
+	AuthPolicy struct {
+		Users   []*AuthUser     `json:"users"`
+		Methods map[string]Role `json:"methods,omitempty"`
+	}
+
+	// rpcEnvelope is the part of a JSON-RPC request needed before dispatch
+	rpcEnvelope struct {
+		Method string           `json:"method"`
+		Params json.RawMessage  `json:"params"`
+		ID     *json.RawMessage `json:"id"`
+	}
+
+	// callerKey is the context key for the identity of the caller
+	callerKey struct{}
+)
+
+// readOnlyMethods are the methods that only read state. Methods not listed
+// here or in operatorMethods require admin, so new methods are never opened up
+// by accident.
+var readOnlyMethods = map[string]bool{
+	"GetInfo":           true,
+	"ListGuests":        true,
+	"GetGuest":          true,
+	"ListContainers":    true,
+	"GetContainer":      true,
+	"GetContainerLogs":  true,
+	"GetContainerStats": true,
+	"GetContainerState": true,
+	"ListSnapshots":     true,
+	"ListJobs":          true,
+	"GetJob":            true,
+	"ListImages":        true,
+	"GetImage":          true,
+}
+
+// operatorMethods are the methods that change guest run state without
+// creating or destroying anything
+var operatorMethods = map[string]bool{
+	"StartContainer":   true,
+	"StopContainer":    true,
+	"RestartContainer": true,
+	"RebootContainer":  true,
+	"PauseContainer":   true,
+	"UnpauseContainer": true,
+}
+
+var roleLevels = map[Role]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// allows returns whether the role has at least the access of another role
+func (r Role) allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+// LoadAuthPolicy reads and validates an authorization policy file
+func LoadAuthPolicy(path string) (*AuthPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &AuthPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks the policy for unknown roles and incomplete users
+func (p *AuthPolicy) Validate() error {
+	tokens := make(map[string]bool)
+	for _, user := range p.Users {
+		if user.Name == "" {
+			return errors.New("user missing name")
+		}
+		if _, ok := roleLevels[user.Role]; !ok {
+			return fmt.Errorf("unknown role %q for user %s", user.Role, user.Name)
+		}
+		if user.Token != "" {
+			if tokens[user.Token] {
+				return fmt.Errorf("duplicate token for user %s", user.Name)
+			}
+			tokens[user.Token] = true
+		}
+	}
+	for method, role := range p.Methods {
+		if _, ok := roleLevels[role]; !ok {
+			return fmt.Errorf("unknown role %q for method %s", role, method)
+		}
+	}
+	return nil
+}
+
+// methodRole returns the role required to call an RPC method
+func (p *AuthPolicy) methodRole(method string) Role {
+	if role, ok := p.Methods[method]; ok {
+		return role
+	}
+	name := strings.TrimPrefix(method, "MDocker.")
+	switch {
+	case readOnlyMethods[name]:
+		return RoleReadOnly
+	case operatorMethods[name]:
+		return RoleOperator
+	default:
+		// Anything unrecognized requires full access
+		return RoleAdmin
+	}
+}
+
+// identify finds the policy user making a request
+func (p *AuthPolicy) identify(r *http.Request) (*AuthUser, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, ErrorUnauthorized{Reason: "unsupported authorization scheme"}
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, user := range p.Users {
+			if user.Token != "" && user.Token == token {
+				return user, nil
+			}
+		}
+		return nil, ErrorUnauthorized{Reason: "unknown token"}
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		name := r.TLS.PeerCertificates[0].Subject.CommonName
+		for _, user := range p.Users {
+			if user.Token == "" && user.Name == name {
+				return user, nil
+			}
+		}
+		return nil, ErrorUnauthorized{Reason: fmt.Sprintf("unknown client certificate %s", name)}
+	}
+
+	return nil, ErrorUnauthorized{Reason: "missing credentials"}
+}
+
+// authorize checks that the caller has the required role, returning the
+// request with the caller's identity attached
+func (p *AuthPolicy) authorize(r *http.Request, required Role) (*http.Request, error) {
+	user, err := p.identify(r)
+	if err != nil {
+		return nil, err
+	}
+	if call := auditCallFrom(r.Context()); call != nil {
+		call.caller = user.Name
+	}
+	if !user.Role.allows(required) {
+		return nil, ErrorUnauthorized{
+			Reason: fmt.Sprintf("%s is not permitted: requires role %s", user.Name, required),
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, user.Name)), nil
+}
+
+// requireRole wraps a plain HTTP handler, rejecting callers without the
+// required role
+func (p *AuthPolicy) requireRole(required Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized, err := p.authorize(r, required)
+		if err != nil {
+			logger(r.Context()).WithFields(log.Fields{
+				"error":      err,
+				"path":       r.URL.Path,
+				"remoteAddr": r.RemoteAddr,
+			}).Warning("unauthorized request")
+			auditDenied(r.Context(), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, authorized)
+	})
+}
+
+// rpcAuthorizer wraps the server's handler, rejecting RPC calls from callers
+// without the role required by the method before they are dispatched
+func (p *AuthPolicy) rpcAuthorizer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != rpc.RPCPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		envelope, err := peekRPCEnvelope(r)
+		if err != nil {
+			// Never dispatch a call whose method couldn't be checked
+			logger(r.Context()).WithFields(log.Fields{
+				"error":      err,
+				"remoteAddr": r.RemoteAddr,
+			}).Warning("invalid rpc request")
+			writeRPCError(r.Context(), w, nil, ErrorValidation{Message: "invalid rpc request: " + err.Error()})
+			return
+		}
+
+		authorized, err := p.authorize(r, p.methodRole(envelope.Method))
+		if err != nil {
+			logger(r.Context()).WithFields(log.Fields{
+				"error":      err,
+				"method":     envelope.Method,
+				"remoteAddr": r.RemoteAddr,
+			}).Warning("unauthorized rpc call")
+			if call := auditCallFrom(r.Context()); call != nil {
+				call.method = envelope.Method
+				call.params = envelope.Params
+			}
+			auditDenied(r.Context(), err)
+			writeRPCError(r.Context(), w, envelope.ID, err)
+			return
+		}
+		next.ServeHTTP(w, authorized)
+	})
+}
+
+// peekRPCEnvelope decodes the method and id of a JSON-RPC request, leaving
+// the body intact for the rpc server. It decodes the same way as jsonCodec,
+// so the two always agree on the method.
+func peekRPCEnvelope(r *http.Request) (*rpcEnvelope, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	logx.LogReturnedErr(r.Body.Close, nil, "failed to close request body")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &rpcEnvelope{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// writeRPCError writes a JSON-RPC error response for a call that was not
+// dispatched
+func writeRPCError(ctx context.Context, w http.ResponseWriter, id *json.RawMessage, err error) {
+	if id == nil {
+		id = &jsonNull
+	}
+	response := &jsonServerResponse{
+		Result: &jsonNull,
+		Error:  rpcErrorWithRequestID(newRPCError(err), requestID(ctx)),
+		ID:     id,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger(ctx).WithField("error", err).Error("failed to write rpc error response")
+	}
+}
@@ -0,0 +1,160 @@
+package mdocker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type AuthTestSuite struct {
+	APITestSuite
+	AuthPort   int
+	AuthServer *graceful.Server
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
+
+func (s *AuthTestSuite) SetupSuite() {
+	s.APITestSuite.SetupSuite()
+
+	policy := &mdocker.AuthPolicy{
+		Users: []*mdocker.AuthUser{
+			{Name: "reader", Token: "read-token", Role: mdocker.RoleReadOnly},
+			{Name: "operator", Token: "operator-token", Role: mdocker.RoleOperator},
+			{Name: "admin", Token: "admin-token", Role: mdocker.RoleAdmin},
+		},
+		Methods: map[string]mdocker.Role{
+			"MDocker.GetImage": mdocker.RoleAdmin,
+		},
+	}
+	s.Require().NoError(policy.Validate())
+
+	var err error
+	s.AuthPort = s.Port + 2
+	s.AuthServer, err = s.MDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		Port: uint(s.AuthPort),
+		Auth: policy,
+	})
+	s.Require().NoError(err)
+	time.Sleep(200 * time.Millisecond)
+}
+
+func (s *AuthTestSuite) TearDownSuite() {
+	stopChan := s.AuthServer.StopChan()
+	s.AuthServer.Stop(5 * time.Second)
+	<-stopChan
+
+	s.APITestSuite.TearDownSuite()
+}
+
+// call makes a raw JSON-RPC call with an optional bearer token and returns
+// the error, if any, from the response
+func (s *AuthTestSuite) call(token, method string, params interface{}) *mdocker.RPCError {
+	body, err := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": []interface{}{params},
+		"id":     0,
+	})
+	s.Require().NoError(err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d%s", s.AuthPort, rpc.RPCPath), bytes.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	var response struct {
+		Error *mdocker.RPCError `json:"error"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+	return response.Error
+}
+
+func (s *AuthTestSuite) TestAuthorization() {
+	tests := []struct {
+		description string
+		token       string
+		method      string
+		allowed     bool
+	}{
+		{"no credentials", "", "MDocker.GetInfo", false},
+		{"unknown token", "asdf", "MDocker.GetInfo", false},
+		{"reader get", "read-token", "MDocker.GetInfo", true},
+		{"reader list", "read-token", "MDocker.ListImages", true},
+		{"reader overridden method", "read-token", "MDocker.GetImage", false},
+		{"reader unknown get", "read-token", "MDocker.GetSecrets", false},
+		{"reader start", "read-token", "MDocker.StartContainer", false},
+		{"operator start", "operator-token", "MDocker.StartContainer", true},
+		{"operator delete", "operator-token", "MDocker.DeleteContainer", false},
+		{"admin delete", "admin-token", "MDocker.DeleteContainer", true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		// Empty requests are enough to see whether the call was dispatched
+		rpcErr := s.call(test.token, test.method, &rpc.GuestRequest{})
+		denied := rpcErr != nil && rpcErr.Code == mdocker.ErrorCodeUnauthorized
+		s.Equal(!test.allowed, denied, msg("unexpected authorization result: %v", rpcErr))
+		if denied {
+			s.NotEmpty(rpcErr.Data["requestId"], msg("should include the request id"))
+		}
+	}
+}
+
+func (s *AuthTestSuite) TestAuthorizationMalformed() {
+	tests := []struct {
+		description string
+		body        string
+		code        mdocker.ErrorCode
+	}{
+		// The rpc server ignores trailing data, so the call must be checked
+		{"trailing data", `{"method":"MDocker.DeleteContainer","params":[{}],"id":0} x`, mdocker.ErrorCodeUnauthorized},
+		{"invalid json", `{"method":`, mdocker.ErrorCodeValidation},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d%s", s.AuthPort, rpc.RPCPath), bytes.NewBufferString(test.body))
+		s.Require().NoError(err, msg("failed to create request"))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer read-token")
+
+		resp, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err, msg("request failed"))
+		var response struct {
+			Error *mdocker.RPCError `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		s.Require().NoError(err, msg("should respond with an rpc error"))
+		if s.NotNil(response.Error, msg("should not dispatch")) {
+			s.Equal(test.code, response.Error.Code, msg("unexpected error code"))
+		}
+	}
+}
+
+func (s *AuthTestSuite) TestLoadAuthPolicy() {
+	_, err := mdocker.LoadAuthPolicy("/dev/null/missing")
+	s.Error(err, "should fail on a missing file")
+
+	badRole := &mdocker.AuthPolicy{
+		Users: []*mdocker.AuthUser{{Name: "foo", Role: "superuser"}},
+	}
+	s.Error(badRole.Validate(), "should reject unknown roles")
+}
@@ -0,0 +1,170 @@
+package mdocker
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// cloneRepositoryPrefix prefixes the new guest id to form the repository of
+// the image a clone is created from
+const cloneRepositoryPrefix = "mistify-clone/"
+
+type (
+	// CloneRequest is a request to create a copy of a guest
+	CloneRequest struct {
+		// ID is the id of the guest to clone
+		ID string `json:"id"`
+		// Guest is the new guest. It needs its own id and nics, with MAC
+		// addresses different from the original's.
+		Guest *client.Guest `json:"guest"`
+	}
+)
+
+// validate checks the request fields
+func (r *CloneRequest) validate() error {
+	if r.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if r.Guest == nil || r.Guest.ID == "" {
+		return ErrorValidation{Message: "missing guest with id"}
+	}
+	if r.Guest.ID == r.ID {
+		return ErrorValidation{Message: "clone must have a new guest id"}
+	}
+	if len(r.Guest.Nics) == 0 {
+		return ErrorValidation{Message: "must specify at least one nic"}
+	}
+	return nil
+}
+
+// cloneRef returns the image reference a clone is created from
+func cloneRef(guestID string) string {
+	return cloneRepositoryPrefix + guestID + ":latest"
+}
+
+// CloneContainer creates a new guest from a copy of an existing guest's
+// filesystem. The source container is committed to an image, which the new
+// container is created from with the same configuration and resource
+// settings, but the new guest's id, hostname and nics. The image is kept,
+// since the new container depends on it, unless the container can't be
+// created.
+func (md *MDocker) CloneContainer(h *http.Request, request *CloneRequest, response *rpc.GuestResponse) error {
+	if err := request.validate(); err != nil {
+		return err
+	}
+	guest := request.Guest
+
+	source, err := md.client.InspectContainerWithContext(request.ID, h.Context())
+	if err != nil {
+		return err
+	}
+
+	// Published ports belong to the original, so the clone only gets the
+	// ones declared for it
+	ports, portLabels, err := guestPorts(guest)
+	if err != nil {
+		return err
+	}
+	if len(ports) > 0 {
+		md.portsMutex.Lock()
+		defer md.portsMutex.Unlock()
+		if err := md.checkPortConflicts(h.Context(), ports); err != nil {
+			return err
+		}
+	}
+
+	// The clone is the same kind of guest as the original, from the same
+	// image, with the same resources
+	original := guestFromContainer(h.Context(), source)
+	guest.Type = original.Type
+	guest.Image = original.Image
+	guest.Memory = original.Memory
+	guest.CPU = original.CPU
+
+	labels, err := guestLabels(guest)
+	if err != nil {
+		return err
+	}
+
+	// The clone is a new guest, so it gets the current security policy and
+	// devices for its own metadata rather than those of the original
+	var hostConfig docker.HostConfig
+	if source.HostConfig != nil {
+		hostConfig = *source.HostConfig
+	}
+	hostConfig.CapAdd = nil
+	hostConfig.CapDrop = nil
+	hostConfig.SecurityOpt = nil
+	hostConfig.ReadonlyRootfs = false
+	hostConfig.PidsLimit = nil
+	hostConfig.Ulimits = nil
+	hostConfig.Devices, err = guestDevices(md.getDevices(), guest)
+	if err != nil {
+		return err
+	}
+	if err := md.getSecurityPolicy().apply(guest, &hostConfig); err != nil {
+		return err
+	}
+
+	ctx := detachedContext(h.Context())
+	commitOpts := docker.CommitContainerOptions{
+		Container:  source.ID,
+		Repository: cloneRepositoryPrefix + guest.ID,
+		Tag:        "latest",
+		Message:    "clone of " + request.ID,
+		Run: &docker.Config{
+			Labels: managedLabels(kindClone, guest.ID, ""),
+		},
+		Context: ctx,
+	}
+	image, err := md.client.CommitContainer(commitOpts)
+	if err != nil {
+		return err
+	}
+
+	config := *source.Config
+	config.Hostname = guest.ID
+	config.Image = cloneRef(guest.ID)
+	config.MacAddress = guest.Nics[0].Mac
+	// Keep labels from the image or set by others, but not the ones
+	// describing the original guest
+	config.Labels = make(map[string]string)
+	for key, value := range source.Config.Labels {
+		if key != portsLabel && key != portsAddressLabel && !strings.HasPrefix(key, guestLabelPrefix) {
+			config.Labels[key] = value
+		}
+	}
+	config.Labels = mergeLabels(config.Labels, labels)
+	config.Labels = mergeLabels(config.Labels, portLabels)
+	createOpts := docker.CreateContainerOptions{
+		Name:       guest.ID,
+		Config:     &config,
+		HostConfig: &hostConfig,
+		Context:    ctx,
+	}
+	container, err := md.client.CreateContainer(createOpts)
+	if err != nil {
+		if removeErr := md.client.RemoveImage(image.ID); removeErr != nil {
+			logger(ctx).WithFields(log.Fields{
+				"error": removeErr,
+				"guest": guest.ID,
+				"image": image.ID,
+			}).Error("failed to remove image after failed clone")
+		}
+		return err
+	}
+
+	state, err := md.fetchContainerState(ctx, container.ID)
+	if err != nil {
+		return err
+	}
+
+	guest.State = state
+	response.Guest = guest
+	return nil
+}
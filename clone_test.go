@@ -0,0 +1,81 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestCloneContainer() {
+	guest := s.createContainer()
+
+	newGuest := func() *client.Guest {
+		return &client.Guest{
+			ID: uuid.New(),
+			Nics: []client.Nic{
+				{
+					Name:    "test",
+					Network: s.Bridge,
+					Mac:     "13:7D:DA:F2:ED:64",
+				},
+			},
+		}
+	}
+	noNics := newGuest()
+	noNics.Nics = nil
+	// The default policy adds no capabilities
+	violation := newGuest()
+	violation.Metadata = map[string]string{mdocker.CapAddMetadataKey: "SYS_ADMIN"}
+
+	tests := []struct {
+		description  string
+		request      *mdocker.CloneRequest
+		expectedErr  bool
+		expectedCode mdocker.ErrorCode
+	}{
+		{"missing id",
+			&mdocker.CloneRequest{Guest: newGuest()}, true, 0},
+		{"missing guest",
+			&mdocker.CloneRequest{ID: guest.ID}, true, 0},
+		{"same id",
+			&mdocker.CloneRequest{ID: guest.ID, Guest: &client.Guest{ID: guest.ID, Nics: guest.Nics}}, true, 0},
+		{"missing nics",
+			&mdocker.CloneRequest{ID: guest.ID, Guest: noNics}, true, 0},
+		{"invalid id",
+			&mdocker.CloneRequest{ID: "asdf", Guest: newGuest()}, true, 0},
+		{"policy violation",
+			&mdocker.CloneRequest{ID: guest.ID, Guest: violation}, true, mdocker.ErrorCodePolicyViolation},
+		{"valid",
+			&mdocker.CloneRequest{ID: guest.ID, Guest: newGuest()}, false, 0},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &rpc.GuestResponse{}
+		err := s.Client.Do("MDocker.CloneContainer", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			if test.expectedCode != 0 {
+				rpcErr := s.rpcError("MDocker.CloneContainer", test.request)
+				if s.NotNil(rpcErr, msg("should fail")) {
+					s.Equal(test.expectedCode, rpcErr.Code, msg("unexpected error code: %s", rpcErr.Message))
+				}
+			}
+			continue
+		}
+		if !s.NoError(err, msg("should succeed")) {
+			continue
+		}
+		s.ContainerIDs = append(s.ContainerIDs, response.Guest.ID)
+		s.Equal(test.request.Guest.ID, response.Guest.ID, msg("should have the new id"))
+		s.Equal(guest.Memory, response.Guest.Memory, msg("should have the same memory"))
+		s.Equal(mdocker.GuestStateCreated, response.Guest.State, msg("should be created"))
+
+		container, err := s.Docker.InspectContainer(response.Guest.ID)
+		if s.NoError(err, msg("should create a container")) {
+			s.Equal(response.Guest.ID, container.Config.Hostname, msg("should have the new hostname"))
+			s.Equal(test.request.Guest.Nics[0].Mac, container.Config.MacAddress, msg("should have the new mac"))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent-docker"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	flag "github.com/ogier/pflag"
+)
+
+// bindFlags defines the configuration flags on a flag set, using the config's
+// current values as the defaults
+func bindFlags(flags *flag.FlagSet, config *mdocker.Config) {
+	flags.UintVarP(&config.Listen.Port, "port", "p", config.Listen.Port, "listen port")
+	flags.StringVarP(&config.Listen.Address, "address", "a", config.Listen.Address, "listen address. defaults to all interfaces")
+	flags.StringVar(&config.Listen.UnixSocket, "unix-socket", config.Listen.UnixSocket, "listen on a unix socket instead of tcp")
+	flags.StringVar(&config.Listen.SocketMode, "socket-mode", config.Listen.SocketMode, "unix socket permissions")
+	flags.BoolVar(&config.Listen.SystemdSocket, "systemd-socket", config.Listen.SystemdSocket, "listen on the socket passed by systemd socket activation")
+	flags.StringVarP(&config.Docker.Endpoint, "endpoint", "e", config.Docker.Endpoint, "docker endpoint")
+	flags.StringVarP(&config.Docker.CertPath, "docker-cert-path", "d", config.Docker.CertPath, "docker tls cert path")
+	flags.StringVarP(&config.ImageService, "image-service", "i", config.ImageService, "image service. srv query used to find port if not specified")
+	flags.StringVarP(&config.LogLevel, "log-level", "l", config.LogLevel, "log level: debug/info/warning/error/critical/fatal")
+	flags.StringVar(&config.TLS.CertFile, "tls-cert", config.TLS.CertFile, "rpc server tls certificate file. enables tls")
+	flags.StringVar(&config.TLS.KeyFile, "tls-key", config.TLS.KeyFile, "rpc server tls key file")
+	flags.StringVar(&config.TLS.ClientCAFile, "tls-client-ca", config.TLS.ClientCAFile, "ca file for verifying client certificates. enables mutual tls")
+	flags.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "time to wait for in-flight requests on shutdown")
+	flags.StringVar(&config.AuthPolicy, "auth-policy", config.AuthPolicy, "authorization policy file. enables role-based authorization")
+}
+
+// loadConfig loads the config file and environment overrides, then applies
+// any flags set on the command line, which take precedence
+func loadConfig(path string) (*mdocker.Config, error) {
+	config, err := mdocker.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bindFlags(overrides, config)
+	flag.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) == nil {
+			return
+		}
+		if e := overrides.Set(f.Name, f.Value.String()); e != nil && err == nil {
+			err = e
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// reload applies the reloadable settings from the config file: the log
+// level, image service and resource limits
+func reload(md *mdocker.MDocker, path string) {
+	config, err := loadConfig(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  path,
+		}).Error("failed to reload configuration")
+		return
+	}
+	if err := logx.DefaultSetup(config.LogLevel); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"func":  "logx.DefaultSetup",
+		}).Error("failed to set log level")
+		return
+	}
+	if err := md.Reconfigure(config); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"func":  "md.Reconfigure",
+		}).Error("failed to apply configuration")
+		return
+	}
+	log.WithFields(log.Fields{
+		"logLevel":  config.LogLevel,
+		"resources": config.Resources,
+		"exportDir": config.ExportDir,
+	}).Info("reloaded configuration")
+}
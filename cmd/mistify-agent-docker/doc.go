@@ -7,10 +7,90 @@ The following arguments are understood:
 
 	$ mistify-agent-docker -h
 	Usage of mistify-agent-docker:
+	-a, --address="": listen address. defaults to all interfaces
+	    --auth-policy="": authorization policy file. enables role-based authorization
+	-c, --config="": config file
 	-d, --docker-cert-path="": docker tls cert path
+	    --drain-timeout=30s: time to wait for in-flight requests on shutdown
 	-e, --endpoint="unix:///var/run/docker.sock": docker endpoint
 	-i, --image-service="image.services.lochness.local": image service. srv query used to find port if not specified
 	-l, --log-level="warning": log level: debug/info/warning/error/critical/fatal
 	-p, --port=30001: listen port
+	    --socket-mode="0660": unix socket permissions
+	    --systemd-socket=false: listen on the socket passed by systemd socket activation
+	    --tls-cert="": rpc server tls certificate file. enables tls
+	    --tls-client-ca="": ca file for verifying client certificates. enables mutual tls
+	    --tls-key="": rpc server tls key file
+	    --unix-socket="": listen on a unix socket instead of tcp
+
+Configuration
+
+Settings can also be read from a YAML config file, given with --config or
+MDOCKER_CONFIG, and overridden by environment variables. Flags set on the
+command line take precedence over both, which take precedence over the
+defaults. An example config file with all of the settings:
+
+	docker:
+	  endpoint: unix:///var/run/docker.sock
+	  certPath: ""
+	imageService: image.services.lochness.local
+	logLevel: warning
+	listen:
+	  address: 127.0.0.1
+	  port: 30001
+	  unixSocket: ""
+	  socketMode: "0660"
+	  systemdSocket: false
+	tls:
+	  certFile: /etc/mistify/tls/cert.pem
+	  keyFile: /etc/mistify/tls/key.pem
+	  clientCAFile: /etc/mistify/tls/ca.pem
+	authPolicy: /etc/mistify/auth.json
+	network:
+	  backend: ovs # or none
+	resources:
+	  defaultMemory: 512 # MB
+	  maxMemory: 4096 # MB
+	  maxCPU: 4
+	security:
+	  capDrop: [NET_RAW, MKNOD]
+	  seccompProfile: /etc/mistify/seccomp.json
+	  noNewPrivileges: true
+	  pidsLimit: 1024
+	  ulimits:
+	    - {name: nofile, soft: 4096, hard: 8192}
+	devices:
+	  - name: zfs
+	    pathOnHost: /dev/zfs
+	    permissions: rwm
+	    default: true
+	  - name: fuse
+	    pathOnHost: /dev/fuse
+	audit:
+	  path: /var/log/mistify/audit.log
+	  maxSize: 100 # MB
+	  maxBackups: 5
+	exportDir: /var/lib/mistify/exports
+	drainTimeout: 30s
+
+Each setting other than lists has an environment variable named after its
+path, prefixed with MDOCKER_, e.g. MDOCKER_DOCKER_ENDPOINT, MDOCKER_LISTEN_PORT
+and MDOCKER_RESOURCES_MAX_MEMORY.
+
+On SIGHUP the config is reloaded, applying changes to the log level, image
+service, resource limits, security policy, device allowlist and export
+directory. Other settings require a restart.
+
+Shutdown
+
+On SIGINT or SIGTERM the server stops accepting connections and waits up to the
+drain timeout for in-flight requests, such as image downloads, and background
+jobs, such as exports, to finish. Jobs still running after that are cancelled
+and given a few seconds to clean up. A second signal exits immediately. The exit status is:
+
+	0 - clean shutdown
+	1 - failed to start
+	2 - in-flight requests did not finish within the drain timeout
+	3 - interrupted by a second signal while draining
 */
 package main
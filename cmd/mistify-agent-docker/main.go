@@ -1,53 +1,143 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-agent-docker"
 	logx "github.com/mistifyio/mistify-logrus-ext"
 	flag "github.com/ogier/pflag"
+	"github.com/tylerb/graceful"
+)
+
+// Exit statuses
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitDrainTimeout = 2
+	exitInterrupted  = 3
 )
 
 func main() {
 	// Handle cli flags
-	var port uint
-	var endpoint, logLevel, tlsCertPath, imageService string
-	flag.UintVarP(&port, "port", "p", 30001, "listen port")
-	flag.StringVarP(&endpoint, "endpoint", "e", "unix:///var/run/docker.sock", "docker endpoint")
-	flag.StringVarP(&tlsCertPath, "docker-cert-path", "d", os.Getenv("DOCKER_CERT_PATH"), "docker tls cert path")
-	flag.StringVarP(&imageService, "image-service", "i", "image.services.lochness.local", "image service. srv query used to find port if not specified")
-	flag.StringVarP(&logLevel, "log-level", "l", "warning", "log level: debug/info/warning/error/critical/fatal")
+	var configPath string
+	flag.StringVarP(&configPath, "config", "c", os.Getenv(mdocker.EnvPrefix+"CONFIG"), "config file")
+	bindFlags(flag.CommandLine, mdocker.DefaultConfig())
 	flag.Parse()
 
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  configPath,
+			"func":  "loadConfig",
+		}).Fatal("invalid configuration")
+	}
+
 	// Set up logging
-	if err := logx.DefaultSetup(logLevel); err != nil {
+	if err := logx.DefaultSetup(config.LogLevel); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"func":  "logx.DefaultSetup",
 		}).Fatal("Could not set up logging")
 	}
 
-	// Prepare docker connection configuration
+	// Only log settings that don't reveal key locations or other services
 	log.WithFields(log.Fields{
-		"port":     port,
-		"logLevel": logLevel,
-		"docker": map[string]interface{}{
-			"endpoint": endpoint,
-			"certPath": tlsCertPath,
-		},
+		"file":          configPath,
+		"logLevel":      config.LogLevel,
+		"listenAddress": config.Listen.Address,
+		"listenPort":    config.Listen.Port,
+		"unixSocket":    config.Listen.UnixSocket,
+		"systemdSocket": config.Listen.SystemdSocket,
+		"network":       config.Network.Backend,
+		"tls":           config.TLS.CertFile != "",
+		"mutualTLS":     config.TLS.ClientCAFile != "",
+		"authorization": config.AuthPolicy != "",
+		"audit":         config.Audit.Path != "",
+		"resources":     config.Resources,
+		"exportDir":     config.ExportDir,
+		"drainTimeout":  config.DrainTimeout,
 	}).Info("configuration")
 
 	// Create the MDocker instance
-	md, err := mdocker.New(endpoint, imageService, tlsCertPath)
+	md, err := mdocker.NewWithConfig(config)
 	if err != nil {
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}
 
 	// Create and run the HTTP server
-	server, err := md.RunHTTP(port)
+	httpConfig, err := config.HTTPConfig()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"func":  "config.HTTPConfig",
+		}).Fatal("failed to configure server")
+	}
+	httpConfig.NoSignalHandling = true
+	if config.Listen.SystemdSocket {
+		httpConfig.Listener, err = systemdListener()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"func":  "systemdListener",
+			}).Fatal("failed to get systemd socket")
+		}
+	}
+	server, err := md.RunHTTPWithConfig(httpConfig)
 	if err != nil {
-		// Block until the server is stopped
-		<-server.StopChan()
+		os.Exit(exitFailure)
+	}
+
+	// Block until asked to stop, reloading the config on SIGHUP
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		reload(md, configPath)
+	}
+	log.WithFields(log.Fields{
+		"signal":       sig,
+		"drainTimeout": config.DrainTimeout,
+	}).Info("shutting down")
+
+	// A second signal skips waiting for the drain
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				log.WithField("signal", sig).Warning("interrupted while draining")
+				os.Exit(exitInterrupted)
+			}
+		}
+	}()
+
+	os.Exit(shutdown(md, server, config.DrainTimeout))
+}
+
+// shutdown stops accepting new requests and waits for in-flight ones to
+// finish, returning the exit status
+func shutdown(md *mdocker.MDocker, server *graceful.Server, timeout time.Duration) int {
+	defer md.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for open ones to finish. Requests
+	// still running when the timeout passes have their connections closed.
+	stopChan := server.StopChan()
+	server.Stop(timeout)
+	<-stopChan
+
+	// Closing a connection doesn't stop the operation it requested, e.g. an
+	// image download, so also wait for those
+	if err := md.WaitIdle(ctx); err != nil {
+		log.WithField("error", err).Error("timed out waiting for in-flight requests")
+		return exitDrainTimeout
 	}
+	log.Info("shutdown complete")
+	return exitOK
 }
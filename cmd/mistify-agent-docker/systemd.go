@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by systemd
+const systemdListenFDsStart = 3
+
+// systemdListener returns the listener passed by systemd socket activation
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("expected one socket from systemd, got %d", fds)
+	}
+
+	// Don't pass the sockets on to any child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+
+	file := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer func() { _ = file.Close() }()
+	return net.FileListener(file)
+}
@@ -0,0 +1,261 @@
+package mdocker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of environment variables that override config
+// file settings
+const EnvPrefix = "MDOCKER_"
+
+type (
+	// Config is the full configuration of the subagent, as read from a YAML
+	// config file
+	Config struct {
+		Docker       DockerConfig   `yaml:"docker"`
+		ImageService string         `yaml:"imageService"`
+		LogLevel     string         `yaml:"logLevel"`
+		Listen       ListenConfig   `yaml:"listen"`
+		TLS          TLSConfig      `yaml:"tls"`
+		AuthPolicy   string         `yaml:"authPolicy"`
+		Network      NetworkConfig  `yaml:"network"`
+		Resources    ResourceLimits `yaml:"resources"`
+		Security     SecurityPolicy `yaml:"security"`
+		Devices      []DeviceConfig `yaml:"devices"`
+		Audit        AuditConfig    `yaml:"audit"`
+		ExportDir    string         `yaml:"exportDir"`
+		DrainTimeout time.Duration  `yaml:"drainTimeout"`
+	}
+
+	// DockerConfig is the docker daemon connection configuration
+	DockerConfig struct {
+		Endpoint string `yaml:"endpoint"`
+		CertPath string `yaml:"certPath"`
+	}
+
+	// ListenConfig is where the RPC server listens
+	ListenConfig struct {
+		Address    string `yaml:"address"`
+		Port       uint   `yaml:"port"`
+		UnixSocket string `yaml:"unixSocket"`
+		// SocketMode is the octal permission mode of the unix socket
+		SocketMode    string `yaml:"socketMode"`
+		SystemdSocket bool   `yaml:"systemdSocket"`
+	}
+
+	// NetworkConfig is the guest networking configuration
+	NetworkConfig struct {
+		// Backend is either "ovs" or "none"
+		Backend string `yaml:"backend"`
+	}
+)
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		Docker: DockerConfig{
+			Endpoint: "unix:///var/run/docker.sock",
+			CertPath: os.Getenv("DOCKER_CERT_PATH"),
+		},
+		ImageService: "image.services.lochness.local",
+		LogLevel:     "warning",
+		Listen: ListenConfig{
+			Port:       30001,
+			SocketMode: "0660",
+		},
+		Network: NetworkConfig{
+			Backend: NetworkBackendOVS,
+		},
+		Devices: []DeviceConfig{
+			{
+				Name:       "zfs",
+				PathOnHost: "/dev/zfs",
+				Default:    true,
+			},
+		},
+		Audit: AuditConfig{
+			MaxSize:    DefaultAuditMaxSize,
+			MaxBackups: DefaultAuditMaxBackups,
+		},
+		DrainTimeout: 30 * time.Second,
+	}
+}
+
+// LoadConfig builds a configuration from the defaults, the config file, if a
+// path is provided, and then environment variable overrides, and validates
+// the result
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// envSettings maps environment variable names, without the prefix, to the
+// settings they override
+func (c *Config) envSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"DOCKER_ENDPOINT":            &c.Docker.Endpoint,
+		"DOCKER_CERT_PATH":           &c.Docker.CertPath,
+		"IMAGE_SERVICE":              &c.ImageService,
+		"LOG_LEVEL":                  &c.LogLevel,
+		"LISTEN_ADDRESS":             &c.Listen.Address,
+		"LISTEN_PORT":                &c.Listen.Port,
+		"LISTEN_UNIX_SOCKET":         &c.Listen.UnixSocket,
+		"LISTEN_SOCKET_MODE":         &c.Listen.SocketMode,
+		"LISTEN_SYSTEMD_SOCKET":      &c.Listen.SystemdSocket,
+		"TLS_CERT_FILE":              &c.TLS.CertFile,
+		"TLS_KEY_FILE":               &c.TLS.KeyFile,
+		"TLS_CLIENT_CA_FILE":         &c.TLS.ClientCAFile,
+		"AUTH_POLICY":                &c.AuthPolicy,
+		"NETWORK_BACKEND":            &c.Network.Backend,
+		"RESOURCES_DEFAULT_MEMORY":   &c.Resources.DefaultMemory,
+		"RESOURCES_MAX_MEMORY":       &c.Resources.MaxMemory,
+		"RESOURCES_MAX_CPU":          &c.Resources.MaxCPU,
+		"SECURITY_SECCOMP_PROFILE":   &c.Security.SeccompProfile,
+		"SECURITY_APPARMOR_PROFILE":  &c.Security.AppArmorProfile,
+		"SECURITY_NO_NEW_PRIVILEGES": &c.Security.NoNewPrivileges,
+		"SECURITY_READ_ONLY_ROOTFS":  &c.Security.ReadOnlyRootfs,
+		"SECURITY_PIDS_LIMIT":        &c.Security.PidsLimit,
+		"AUDIT_PATH":                 &c.Audit.Path,
+		"AUDIT_MAX_SIZE":             &c.Audit.MaxSize,
+		"AUDIT_MAX_BACKUPS":          &c.Audit.MaxBackups,
+		"EXPORT_DIR":                 &c.ExportDir,
+		"DRAIN_TIMEOUT":              &c.DrainTimeout,
+	}
+}
+
+// applyEnv overrides settings with any set environment variables
+func (c *Config) applyEnv() error {
+	for name, setting := range c.envSettings() {
+		value, ok := os.LookupEnv(EnvPrefix + name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch s := setting.(type) {
+		case *string:
+			*s = value
+		case *uint:
+			var u uint64
+			u, err = strconv.ParseUint(value, 10, 0)
+			*s = uint(u)
+		case *int64:
+			*s, err = strconv.ParseInt(value, 10, 64)
+		case *bool:
+			*s, err = strconv.ParseBool(value)
+		case *time.Duration:
+			*s, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s%s: %s", EnvPrefix, name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration for invalid and conflicting settings
+func (c *Config) Validate() error {
+	if c.Docker.Endpoint == "" {
+		return errors.New("docker endpoint required")
+	}
+	if c.LogLevel != "" {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	if _, err := c.Listen.FileMode(); err != nil {
+		return err
+	}
+	if c.Listen.UnixSocket != "" && c.Listen.SystemdSocket {
+		return errors.New("only one of unix socket and systemd socket may be set")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls requires both a cert and key file")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return errors.New("tls client ca requires a cert and key file")
+	}
+	if _, err := newNetworkBackend(c.Network.Backend); err != nil {
+		return err
+	}
+	if err := c.Resources.Validate(); err != nil {
+		return err
+	}
+	if err := c.Security.Validate(); err != nil {
+		return err
+	}
+	if err := validateDevices(c.Devices); err != nil {
+		return err
+	}
+	if err := c.Audit.Validate(); err != nil {
+		return err
+	}
+	if c.ExportDir != "" && !filepath.IsAbs(c.ExportDir) {
+		return errors.New("export dir must be absolute")
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("drain timeout must not be negative")
+	}
+	return nil
+}
+
+// FileMode parses the unix socket permission mode
+func (l ListenConfig) FileMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return DefaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// HTTPConfig builds the RPC server configuration, loading the authorization
+// policy if one is set
+func (c *Config) HTTPConfig() (HTTPConfig, error) {
+	mode, err := c.Listen.FileMode()
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	httpConfig := HTTPConfig{
+		Address:    c.Listen.Address,
+		Port:       c.Listen.Port,
+		UnixSocket: c.Listen.UnixSocket,
+		SocketMode: mode,
+	}
+	if c.TLS.CertFile != "" {
+		tlsConfig := c.TLS
+		httpConfig.TLS = &tlsConfig
+	}
+	if c.AuthPolicy != "" {
+		httpConfig.Auth, err = LoadAuthPolicy(c.AuthPolicy)
+		if err != nil {
+			return HTTPConfig{}, err
+		}
+	}
+	return httpConfig, nil
+}
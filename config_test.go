@@ -0,0 +1,177 @@
+package mdocker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+	File string
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
+
+func (s *ConfigTestSuite) SetupTest() {
+	f, err := ioutil.TempFile("", "mdocker-config")
+	s.Require().NoError(err)
+	s.File = f.Name()
+	s.Require().NoError(f.Close())
+}
+
+func (s *ConfigTestSuite) TearDownTest() {
+	_ = os.Remove(s.File)
+	_ = os.Unsetenv(mdocker.EnvPrefix + "LISTEN_PORT")
+}
+
+func (s *ConfigTestSuite) writeConfig(data string) {
+	s.Require().NoError(ioutil.WriteFile(s.File, []byte(data), 0600))
+}
+
+func (s *ConfigTestSuite) TestLoadConfig() {
+	config, err := mdocker.LoadConfig("")
+	if s.NoError(err, "should load defaults without a file") {
+		s.Equal(mdocker.DefaultConfig(), config)
+	}
+
+	_, err = mdocker.LoadConfig("/dev/null/missing")
+	s.Error(err, "should fail on a missing file")
+
+	s.writeConfig(`
+imageService: images.example.com:8080
+listen:
+  port: 40000
+resources:
+  maxMemory: 1024
+drainTimeout: 5s
+`)
+	config, err = mdocker.LoadConfig(s.File)
+	if s.NoError(err) {
+		s.Equal("images.example.com:8080", config.ImageService)
+		s.Equal(uint(40000), config.Listen.Port)
+		s.Equal(uint(1024), config.Resources.MaxMemory)
+		s.Equal(5*time.Second, config.DrainTimeout)
+		s.Equal("unix:///var/run/docker.sock", config.Docker.Endpoint, "should keep defaults for unset settings")
+	}
+
+	s.Require().NoError(os.Setenv(mdocker.EnvPrefix+"LISTEN_PORT", "40001"))
+	config, err = mdocker.LoadConfig(s.File)
+	if s.NoError(err) {
+		s.Equal(uint(40001), config.Listen.Port, "environment should override the file")
+	}
+
+	s.Require().NoError(os.Setenv(mdocker.EnvPrefix+"LISTEN_PORT", "foo"))
+	_, err = mdocker.LoadConfig(s.File)
+	s.Error(err, "should reject invalid environment values")
+}
+
+func (s *ConfigTestSuite) TestValidate() {
+	tests := []struct {
+		description string
+		modify      func(*mdocker.Config)
+		expectedErr bool
+	}{
+		{"defaults",
+			func(c *mdocker.Config) {}, false},
+		{"missing endpoint",
+			func(c *mdocker.Config) { c.Docker.Endpoint = "" }, true},
+		{"bad log level",
+			func(c *mdocker.Config) { c.LogLevel = "loud" }, true},
+		{"bad socket mode",
+			func(c *mdocker.Config) { c.Listen.SocketMode = "rw" }, true},
+		{"unix and systemd sockets",
+			func(c *mdocker.Config) { c.Listen.UnixSocket = "/tmp/foo"; c.Listen.SystemdSocket = true }, true},
+		{"tls cert without key",
+			func(c *mdocker.Config) { c.TLS.CertFile = "cert.pem" }, true},
+		{"unknown network backend",
+			func(c *mdocker.Config) { c.Network.Backend = "bridge" }, true},
+		{"default memory over max",
+			func(c *mdocker.Config) { c.Resources.DefaultMemory = 2; c.Resources.MaxMemory = 1 }, true},
+		{"relative device path",
+			func(c *mdocker.Config) { c.Devices = []mdocker.DeviceConfig{{Name: "fuse", PathOnHost: "fuse"}} }, true},
+		{"invalid device permissions",
+			func(c *mdocker.Config) { c.Devices[0].Permissions = "rx" }, true},
+		{"duplicate device",
+			func(c *mdocker.Config) { c.Devices = append(c.Devices, c.Devices[0]) }, true},
+		{"relative export dir",
+			func(c *mdocker.Config) { c.ExportDir = "exports" }, true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		config := mdocker.DefaultConfig()
+		test.modify(config)
+		if test.expectedErr {
+			s.Error(config.Validate(), msg("should be invalid"))
+		} else {
+			s.NoError(config.Validate(), msg("should be valid"))
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestResourceLimits() {
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.Resources = mdocker.ResourceLimits{
+		DefaultMemory: 10,
+		MaxMemory:     20,
+		MaxCPU:        1,
+	}
+	s.Require().NoError(s.MDocker.Reconfigure(config))
+	defer func() {
+		config.Resources = mdocker.ResourceLimits{}
+		s.NoError(s.MDocker.Reconfigure(config))
+	}()
+
+	nics := []client.Nic{
+		{
+			Name:    "test",
+			Network: s.Bridge,
+			Mac:     "13:7D:DA:F2:ED:63",
+		},
+	}
+
+	tests := []struct {
+		description    string
+		guest          *client.Guest
+		expectedErr    bool
+		expectedMemory uint
+	}{
+		{"default memory",
+			&client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID}, false, 10},
+		{"memory within limit",
+			&client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID, Memory: 20}, false, 20},
+		{"memory over limit",
+			&client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID, Memory: 30}, true, 0},
+		{"cpu over limit",
+			&client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID, CPU: 2}, true, 0},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+
+		response := &rpc.GuestResponse{}
+		request := &rpc.GuestRequest{Guest: test.guest}
+		err := s.Client.Do("MDocker.CreateContainer", request, response)
+		if response.Guest != nil {
+			s.ContainerIDs = append(s.ContainerIDs, response.Guest.ID)
+		}
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) {
+			s.Equal(test.expectedMemory, response.Guest.Memory, msg("unexpected memory"))
+		}
+	}
+}
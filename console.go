@@ -0,0 +1,251 @@
+package mdocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// ConsolePath is the path of the WebSocket console endpoint. The {id}
+// segment is the container id or name.
+const ConsolePath = "/containers/{id}/console"
+
+type (
+	// ConsoleControl is a control message sent by a console client as a
+	// WebSocket text message. Binary messages are passed through as stdin.
+	ConsoleControl struct {
+		Type   string `json:"type"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+
+	// wsWriter sends everything written to it as binary WebSocket messages
+	wsWriter struct {
+		mutex sync.Mutex
+		conn  *websocket.Conn
+	}
+
+	// consoleSession is an attached console stream, either to the container
+	// itself or to an interactive exec instance inside it
+	consoleSession struct {
+		closeWaiter docker.CloseWaiter
+		resize      func(height, width int) error
+	}
+)
+
+var consoleUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// Write sends p as a single binary message
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// consoleHandler attaches a WebSocket client to a container's console. If one
+// or more "cmd" query parameters are supplied, an interactive exec instance
+// with a TTY is started instead and the client is attached to it.
+func (md *MDocker) consoleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	containerID := mux.Vars(r)["id"]
+	container, err := md.client.InspectContainer(containerID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			status = http.StatusNotFound
+		}
+		auditFailed(ctx, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !container.State.Running {
+		auditFailed(ctx, ErrorInvalidState{Expected: "running", Actual: guestState(container.State)})
+		http.Error(w, "container is not running", http.StatusConflict)
+		return
+	}
+	if err := md.checkDocker(); err != nil {
+		auditFailed(ctx, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := consoleUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		auditFailed(ctx, err)
+		// The upgrader has already replied to the client
+		logger(ctx).WithFields(log.Fields{
+			"error":       err,
+			"containerID": containerID,
+		}).Error("failed to upgrade console connection")
+		return
+	}
+	defer logx.LogReturnedErr(conn.Close, nil, "failed to close console connection")
+
+	stdinReader, stdinWriter := io.Pipe()
+	output := &wsWriter{conn: conn}
+
+	var session *consoleSession
+	if cmd := r.URL.Query()["cmd"]; len(cmd) > 0 {
+		session, err = md.attachExecConsole(ctx, container.ID, cmd, stdinReader, output)
+	} else {
+		session, err = md.attachContainerConsole(ctx, container, stdinReader, output)
+	}
+	if err != nil {
+		auditFailed(ctx, err)
+		logger(ctx).WithFields(log.Fields{
+			"error":       err,
+			"containerID": containerID,
+		}).Error("failed to attach console")
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+		_ = conn.WriteMessage(websocket.CloseMessage, closeMsg)
+		return
+	}
+
+	// When the stream from docker ends (e.g. the exec process exits), close
+	// the connection so the read loop below returns
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := session.closeWaiter.Wait(); err != nil {
+			logger(ctx).WithFields(log.Fields{
+				"error":       err,
+				"containerID": containerID,
+			}).Error("console stream error")
+		}
+		output.mutex.Lock()
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = conn.WriteMessage(websocket.CloseMessage, closeMsg)
+		output.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	md.readConsoleInput(ctx, conn, session, stdinWriter)
+
+	// The client went away. Detach without affecting the container.
+	_ = stdinWriter.Close()
+	if err := session.closeWaiter.Close(); err != nil {
+		logger(ctx).WithFields(log.Fields{
+			"error":       err,
+			"containerID": containerID,
+		}).Error("failed to detach console")
+	}
+	<-done
+}
+
+// readConsoleInput pumps client messages into the session until the client
+// disconnects
+func (md *MDocker) readConsoleInput(ctx context.Context, conn *websocket.Conn, session *consoleSession, stdin io.Writer) {
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch msgType {
+		case websocket.BinaryMessage:
+			if _, err := stdin.Write(data); err != nil {
+				return
+			}
+		case websocket.TextMessage:
+			var ctrl ConsoleControl
+			if err := json.Unmarshal(data, &ctrl); err != nil {
+				logger(ctx).WithField("error", err).Warning("invalid console control message")
+				continue
+			}
+			if ctrl.Type != "resize" {
+				logger(ctx).WithField("type", ctrl.Type).Warning("unknown console control message")
+				continue
+			}
+			if err := session.resize(ctrl.Height, ctrl.Width); err != nil {
+				logger(ctx).WithFields(log.Fields{
+					"error":  err,
+					"height": ctrl.Height,
+					"width":  ctrl.Width,
+				}).Error("failed to resize console")
+			}
+		}
+	}
+}
+
+func (md *MDocker) attachContainerConsole(ctx context.Context, container *docker.Container, stdin io.Reader, output io.Writer) (*consoleSession, error) {
+	if !container.Config.OpenStdin {
+		return nil, errors.New("container does not have stdin open")
+	}
+
+	opts := docker.AttachToContainerOptions{
+		Container:    container.ID,
+		InputStream:  stdin,
+		OutputStream: output,
+		ErrorStream:  output,
+		RawTerminal:  container.Config.Tty,
+		Stream:       true,
+		Stdin:        true,
+		Stdout:       true,
+		Stderr:       true,
+	}
+	start := time.Now()
+	closeWaiter, err := md.client.AttachToContainerNonBlocking(opts)
+	observeDockerStream(ctx, http.MethodPost, "/containers/{id}/attach", start)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consoleSession{
+		closeWaiter: closeWaiter,
+		resize: func(height, width int) error {
+			return md.client.ResizeContainerTTY(container.ID, height, width)
+		},
+	}, nil
+}
+
+func (md *MDocker) attachExecConsole(ctx context.Context, containerID string, cmd []string, stdin io.Reader, output io.Writer) (*consoleSession, error) {
+	createOpts := docker.CreateExecOptions{
+		Container:    containerID,
+		Cmd:          cmd,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+	}
+	exec, err := md.client.CreateExec(createOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	startOpts := docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: output,
+		ErrorStream:  output,
+		Tty:          true,
+		RawTerminal:  true,
+	}
+	start := time.Now()
+	closeWaiter, err := md.client.StartExecNonBlocking(exec.ID, startOpts)
+	observeDockerStream(ctx, http.MethodPost, "/exec/{id}/start", start)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consoleSession{
+		closeWaiter: closeWaiter,
+		resize: func(height, width int) error {
+			return md.client.ResizeExecTTY(exec.ID, height, width)
+		},
+	}, nil
+}
@@ -0,0 +1,66 @@
+package mdocker_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mistifyio/mistify-agent-docker"
+)
+
+func (s *ContainerTestSuite) consoleURL(id string, cmd ...string) string {
+	u := fmt.Sprintf("ws://127.0.0.1:%d%s", s.Port, strings.Replace(mdocker.ConsolePath, "{id}", id, 1))
+	if len(cmd) > 0 {
+		u += "?cmd=" + strings.Join(cmd, "&cmd=")
+	}
+	return u
+}
+
+func (s *ContainerTestSuite) TestConsole() {
+	guest := s.createContainer()
+
+	// Not running yet
+	_, resp, err := websocket.DefaultDialer.Dial(s.consoleURL(guest.ID), nil)
+	s.Error(err, "should fail to attach to a stopped container")
+	if resp != nil {
+		s.Equal(http.StatusConflict, resp.StatusCode)
+	}
+
+	_, resp, err = websocket.DefaultDialer.Dial(s.consoleURL("asdf"), nil)
+	s.Error(err, "should fail to attach to a missing container")
+	if resp != nil {
+		s.Equal(http.StatusNotFound, resp.StatusCode)
+	}
+
+	_, _ = s.containerAction("StartContainer", guest)
+
+	// Attach to the container itself and detach again
+	conn, _, err := websocket.DefaultDialer.Dial(s.consoleURL(guest.ID), nil)
+	s.NoError(err, "should attach to a running container")
+	if conn != nil {
+		s.NoError(conn.WriteJSON(&mdocker.ConsoleControl{Type: "resize", Width: 80, Height: 24}))
+		s.NoError(conn.Close())
+	}
+
+	// Interactive exec
+	conn, _, err = websocket.DefaultDialer.Dial(s.consoleURL(guest.ID, "cat"), nil)
+	s.NoError(err, "should attach to an exec instance")
+	if conn == nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	s.NoError(conn.WriteJSON(&mdocker.ConsoleControl{Type: "resize", Width: 80, Height: 24}))
+	s.NoError(conn.WriteMessage(websocket.BinaryMessage, []byte("foo\n")))
+
+	var output string
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(output, "foo") {
+		_, data, err := conn.ReadMessage()
+		if !s.NoError(err, "should read console output") {
+			break
+		}
+		output += string(data)
+	}
+}
@@ -1,23 +1,17 @@
 package mdocker
 
 import (
-	"errors"
+	"context"
 	"net/http"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/mistifyio/mistify-agent/rpc"
 )
 
-const (
-	cStateRunning = "running"
-	cStatePaused  = "paused"
-	cStateStopped = "stopped"
-)
-
-func (md *MDocker) containersFromAPIContainers(acs []docker.APIContainers) ([]*docker.Container, error) {
+func (md *MDocker) containersFromAPIContainers(ctx context.Context, acs []docker.APIContainers) ([]*docker.Container, error) {
 	containers := make([]*docker.Container, 0, len(acs))
 	for _, ac := range acs {
-		container, err := md.client.InspectContainer(ac.ID)
+		container, err := md.client.InspectContainerWithContext(ac.ID, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -26,46 +20,49 @@ func (md *MDocker) containersFromAPIContainers(acs []docker.APIContainers) ([]*d
 	return containers, nil
 }
 
-func (md *MDocker) fetchContainerState(containerID string) (string, error) {
-	container, err := md.client.InspectContainer(containerID)
+func (md *MDocker) fetchContainerState(ctx context.Context, containerID string) (string, error) {
+	container, err := md.client.InspectContainerWithContext(containerID, ctx)
 	if err != nil {
 		return "", err
 	}
-	if container.State.Paused {
-		return cStatePaused, nil
-	}
-	if container.State.Running {
-		return cStateRunning, nil
-	}
-	return cStateStopped, nil
-}
-
-func assertContainerState(expected, actual string) error {
-	if actual != expected {
-		return errors.New("unexpected container state")
-	}
-	return nil
+	return guestState(container.State), nil
 }
 
 func requestContainerName(request *rpc.GuestRequest) (string, error) {
 	if request.Guest == nil || request.Guest.ID == "" {
-		return "", errors.New("missing guest with id")
+		return "", ErrorValidation{Message: "missing guest with id"}
 	}
 	return request.Guest.ID, nil
 }
 
-// ListContainers retrieves a list of Docker containers
+// ListContainers retrieves a list of the containers created by the agent, or
+// of all Docker containers if requested
 func (md *MDocker) ListContainers(h *http.Request, request *rpc.ContainerRequest, response *rpc.ContainerResponse) error {
 	var opts docker.ListContainersOptions
 	if err := md.RequestOpts(request, &opts); err != nil {
 		return err
 	}
+	var listOpts listOptions
+	if err := md.RequestOpts(request, &listOpts); err != nil {
+		return err
+	}
+	opts.Context = h.Context()
 
 	apiContainers, err := md.client.ListContainers(opts)
 	if err != nil {
 		return err
 	}
-	containers, err := md.containersFromAPIContainers(apiContainers)
+	// Docker can't filter for labeled or legacy containers in one go
+	if !listOpts.IncludeUnmanaged {
+		managed := apiContainers[:0]
+		for _, ac := range apiContainers {
+			if isManagedContainer(ac) {
+				managed = append(managed, ac)
+			}
+		}
+		apiContainers = managed
+	}
+	containers, err := md.containersFromAPIContainers(h.Context(), apiContainers)
 	if err != nil {
 		return err
 	}
@@ -76,7 +73,7 @@ func (md *MDocker) ListContainers(h *http.Request, request *rpc.ContainerRequest
 
 // GetContainer retrieves information about a specific Docker container
 func (md *MDocker) GetContainer(h *http.Request, request *rpc.ContainerRequest, response *rpc.ContainerResponse) error {
-	container, err := md.client.InspectContainer(request.ID)
+	container, err := md.client.InspectContainerWithContext(request.ID, h.Context())
 	if err != nil {
 		return err
 	}
@@ -94,15 +91,24 @@ func (md *MDocker) DeleteContainer(h *http.Request, request *rpc.GuestRequest, r
 		return err
 	}
 
-	opts := docker.RemoveContainerOptions{
-		ID: containerName,
-	}
-	if err := md.client.RemoveContainer(opts); err != nil {
+	ctx := detachedContext(h.Context())
+	state, err := md.transitionGuest(ctx, containerName, transitionDelete, func() error {
+		// Clean up after guests that stopped on their own
+		if err := md.unpublishPorts(ctx, containerName); err != nil {
+			return err
+		}
+		opts := docker.RemoveContainerOptions{
+			ID:      containerName,
+			Context: ctx,
+		}
+		return md.client.RemoveContainer(opts)
+	})
+	if err != nil {
 		return err
 	}
 
 	response.Guest = request.Guest
-	response.Guest.State = "deleted"
+	response.Guest.State = state
 	return nil
 }
 
@@ -115,6 +121,13 @@ func (md *MDocker) SaveContainer(h *http.Request, request *rpc.ContainerRequest,
 	if request.ID != "" {
 		opts.Container = request.ID
 	}
+	// The image would otherwise inherit the container's labels, so mark it
+	// as an image of its own
+	if opts.Run == nil {
+		opts.Run = &docker.Config{}
+	}
+	opts.Run.Labels = mergeLabels(opts.Run.Labels, managedLabels(kindImage, opts.Container, opts.Repository))
+	opts.Context = detachedContext(h.Context())
 	image, err := md.client.CommitContainer(opts)
 	if err != nil {
 		return err
@@ -138,12 +151,26 @@ func (md *MDocker) CreateContainer(h *http.Request, request *rpc.GuestRequest, r
 	guest := request.Guest
 
 	if len(guest.Nics) == 0 {
-		return errors.New("must specify at least one nic")
+		return ErrorValidation{Message: "must specify at least one nic"}
+	}
+	if err := md.getResourceLimits().apply(guest); err != nil {
+		return err
+	}
+	ports, portLabels, err := guestPorts(guest)
+	if err != nil {
+		return err
+	}
+	devices, err := guestDevices(md.getDevices(), guest)
+	if err != nil {
+		return err
+	}
+	labels, err := guestLabels(guest)
+	if err != nil {
+		return err
 	}
 
 	// TODO: Some of these options might be better handled as guest metadata
-	// instead of hardcoding, such as the openstdin option, port forwarding,
-	// and zfs devices
+	// instead of hardcoding, such as the openstdin option
 	opts := docker.CreateContainerOptions{
 		Name: containerName,
 		Config: &docker.Config{
@@ -152,28 +179,38 @@ func (md *MDocker) CreateContainer(h *http.Request, request *rpc.GuestRequest, r
 			OpenStdin:  true,
 			MacAddress: guest.Nics[0].Mac,
 			Memory:     int64(guest.Memory) * 1024 * 1024, // Convert MB to bytes
+			Labels:     mergeLabels(labels, portLabels),
 		},
 		HostConfig: &docker.HostConfig{
 			// A network interface will be added separately. The "none" option
 			// may not be listed in the docker remote api docs, but it works
 			NetworkMode: "none",
-			// Expose /dev/zfs inside all containers (okay because they are unprivileged)
-			Devices: []docker.Device{
-				{
-					PathOnHost:        "/dev/zfs",
-					PathInContainer:   "/dev/zfs",
-					CgroupPermissions: "rwm",
-				},
-			},
+			Devices:     devices,
 		},
 	}
 
+	if err := md.getSecurityPolicy().apply(guest, opts.HostConfig); err != nil {
+		return err
+	}
+
+	// Hold the lock until the container exists, so concurrent requests can't
+	// publish the same port
+	if len(ports) > 0 {
+		md.portsMutex.Lock()
+		defer md.portsMutex.Unlock()
+		if err := md.checkPortConflicts(h.Context(), ports); err != nil {
+			return err
+		}
+	}
+
+	ctx := detachedContext(h.Context())
+	opts.Context = ctx
 	container, err := md.client.CreateContainer(opts)
 	if err != nil {
 		return err
 	}
 
-	state, err := md.fetchContainerState(container.ID)
+	state, err := md.fetchContainerState(ctx, container.ID)
 	if err != nil {
 		return err
 	}
@@ -185,36 +222,35 @@ func (md *MDocker) CreateContainer(h *http.Request, request *rpc.GuestRequest, r
 
 // StartContainer starts a Docker container
 func (md *MDocker) StartContainer(h *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
-	// Make sure there are no lingering interfaces for the guest from a previous
-	// run
-	if err := removeInterfaces(request.Guest); err != nil {
-		return err
-	}
-
 	containerName, err := requestContainerName(request)
 	if err != nil {
 		return err
 	}
-	err = md.client.StartContainer(containerName, nil)
-	if _, ok := err.(*docker.ContainerAlreadyRunning); err != nil && !ok {
+	ctx := detachedContext(h.Context())
+	state, err := md.transitionGuest(ctx, containerName, transitionStart, func() error {
+		// Make sure there are no lingering interfaces for the guest from a
+		// previous run
+		if err := md.network.removeInterfaces(ctx, request.Guest); err != nil {
+			return err
+		}
+		err := md.client.StartContainerWithContext(containerName, nil, ctx)
+		if _, ok := err.(*docker.ContainerAlreadyRunning); ok {
+			return nil
+		}
 		return err
-	}
-	state, err := md.fetchContainerState(containerName)
+	})
 	if err != nil {
 		return err
 	}
-	if err := assertContainerState(cStateRunning, state); err != nil {
-		return err
-	}
 
 	response.Guest = request.Guest
 	response.Guest.State = state
 
-	if err := addInterfaces(request.Guest); err != nil {
+	if err := md.network.addInterfaces(ctx, request.Guest); err != nil {
 		return err
 	}
 
-	return nil
+	return md.publishPorts(ctx, containerName)
 }
 
 // StopContainer stops a Docker container or kills it after a timeout
@@ -223,28 +259,28 @@ func (md *MDocker) StopContainer(h *http.Request, request *rpc.GuestRequest, res
 	if err != nil {
 		return err
 	}
-	err = md.client.StopContainer(containerName, 10)
-	if _, ok := err.(*docker.ContainerNotRunning); err != nil && !ok {
+	ctx := detachedContext(h.Context())
+	state, err := md.transitionGuest(ctx, containerName, transitionStop, func() error {
+		err := md.client.StopContainerWithContext(containerName, 10, ctx)
+		if _, ok := err.(*docker.ContainerNotRunning); ok {
+			return nil
+		}
 		return err
-	}
-	state, err := md.fetchContainerState(containerName)
+	})
 	if err != nil {
 		return err
 	}
-	if err := assertContainerState(cStateStopped, state); err != nil {
-		return err
-	}
 
 	response.Guest = request.Guest
 	response.Guest.State = state
 
 	// The virtual interfaces are destroyed when the container stops, but are
 	// still being tracked in OVS. Clean things up.
-	if err := removeInterfaces(request.Guest); err != nil {
+	if err := md.network.removeInterfaces(ctx, request.Guest); err != nil {
 		return err
 	}
 
-	return nil
+	return md.unpublishPorts(ctx, containerName)
 }
 
 // RestartContainer restarts a Docker container
@@ -274,16 +310,12 @@ func (md *MDocker) PauseContainer(h *http.Request, request *rpc.GuestRequest, re
 	if err != nil {
 		return err
 	}
-	if err := md.client.PauseContainer(containerName); err != nil {
-		return err
-	}
-	state, err := md.fetchContainerState(containerName)
+	state, err := md.transitionGuest(detachedContext(h.Context()), containerName, transitionPause, func() error {
+		return md.client.PauseContainer(containerName)
+	})
 	if err != nil {
 		return err
 	}
-	if err := assertContainerState(cStatePaused, state); err != nil {
-		return err
-	}
 
 	response.Guest = request.Guest
 	response.Guest.State = state
@@ -296,16 +328,12 @@ func (md *MDocker) UnpauseContainer(h *http.Request, request *rpc.GuestRequest,
 	if err != nil {
 		return err
 	}
-	if err := md.client.UnpauseContainer(containerName); err != nil {
-		return err
-	}
-	state, err := md.fetchContainerState(containerName)
+	state, err := md.transitionGuest(detachedContext(h.Context()), containerName, transitionUnpause, func() error {
+		return md.client.UnpauseContainer(containerName)
+	})
 	if err != nil {
 		return err
 	}
-	if err := assertContainerState(cStateRunning, state); err != nil {
-		return err
-	}
 
 	response.Guest = request.Guest
 	response.Guest.State = state
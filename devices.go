@@ -0,0 +1,148 @@
+package mdocker
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+// DevicesMetadataKey is the guest metadata key listing the devices to pass
+// through, as comma separated NAME[:PERMISSIONS] entries. Guests without it
+// get the default devices.
+const DevicesMetadataKey = "devices"
+
+// defaultDevicePermissions are the cgroup permissions of a device that
+// doesn't set any
+const defaultDevicePermissions = "rwm"
+
+type (
+	// DeviceConfig is a host device guests may be given
+	DeviceConfig struct {
+		// Name identifies the device in guest metadata
+		Name       string `yaml:"name"`
+		PathOnHost string `yaml:"pathOnHost"`
+		// PathInContainer defaults to PathOnHost
+		PathInContainer string `yaml:"pathInContainer"`
+		// Permissions are the most cgroup permissions, a combination of r, w
+		// and m, a guest may have. Defaults to rwm.
+		Permissions string `yaml:"permissions"`
+		// Default devices are given to guests that don't list any
+		Default bool `yaml:"default"`
+	}
+)
+
+// permissions returns the device's cgroup permissions, with the default
+// filled in
+func (d DeviceConfig) permissions() string {
+	if d.Permissions == "" {
+		return defaultDevicePermissions
+	}
+	return d.Permissions
+}
+
+// validPermissions checks that permissions are a non-empty combination of
+// the allowed ones without repeats
+func validPermissions(permissions, allowed string) bool {
+	if permissions == "" {
+		return false
+	}
+	for i, p := range permissions {
+		if !strings.ContainsRune(allowed, p) || strings.ContainsRune(permissions[i+1:], p) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateDevices checks the device allowlist
+func validateDevices(devices []DeviceConfig) error {
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if device.Name == "" || strings.ContainsAny(device.Name, ",:") {
+			return fmt.Errorf("invalid device name %q", device.Name)
+		}
+		if seen[device.Name] {
+			return fmt.Errorf("device %s set more than once", device.Name)
+		}
+		seen[device.Name] = true
+		if !filepath.IsAbs(device.PathOnHost) {
+			return fmt.Errorf("device %s path on host must be absolute", device.Name)
+		}
+		if device.PathInContainer != "" && !filepath.IsAbs(device.PathInContainer) {
+			return fmt.Errorf("device %s path in container must be absolute", device.Name)
+		}
+		if !validPermissions(device.permissions(), defaultDevicePermissions) {
+			return fmt.Errorf("device %s has invalid permissions %q", device.Name, device.Permissions)
+		}
+	}
+	return nil
+}
+
+// guestDevices selects the devices to pass through to a new guest from the
+// allowlist, based on the guest's metadata
+func guestDevices(allowed []DeviceConfig, guest *client.Guest) ([]docker.Device, error) {
+	byName := make(map[string]DeviceConfig, len(allowed))
+	for _, device := range allowed {
+		byName[device.Name] = device
+	}
+
+	type selection struct {
+		device      DeviceConfig
+		permissions string
+	}
+	var selected []selection
+	if value, ok := guest.Metadata[DevicesMetadataKey]; ok {
+		seen := make(map[string]bool)
+		for _, entry := range splitList(value) {
+			parts := strings.SplitN(entry, ":", 2)
+			device, ok := byName[parts[0]]
+			if !ok {
+				return nil, ErrorPolicyViolation{
+					Setting: DevicesMetadataKey,
+					Reason:  fmt.Sprintf("device %s is not allowed by the host", parts[0]),
+				}
+			}
+			if seen[device.Name] {
+				return nil, ErrorValidation{Message: fmt.Sprintf("device %s listed more than once", device.Name)}
+			}
+			seen[device.Name] = true
+			permissions := device.permissions()
+			if len(parts) == 2 {
+				if !validPermissions(parts[1], defaultDevicePermissions) {
+					return nil, ErrorValidation{Message: fmt.Sprintf("invalid permissions %q for device %s", parts[1], device.Name)}
+				}
+				if !validPermissions(parts[1], permissions) {
+					return nil, ErrorPolicyViolation{
+						Setting: DevicesMetadataKey,
+						Reason:  fmt.Sprintf("device %s permissions %s exceed the allowed %s", device.Name, parts[1], permissions),
+					}
+				}
+				permissions = parts[1]
+			}
+			selected = append(selected, selection{device, permissions})
+		}
+	} else {
+		for _, device := range allowed {
+			if device.Default {
+				selected = append(selected, selection{device, device.permissions()})
+			}
+		}
+	}
+
+	devices := make([]docker.Device, 0, len(selected))
+	for _, s := range selected {
+		pathInContainer := s.device.PathInContainer
+		if pathInContainer == "" {
+			pathInContainer = s.device.PathOnHost
+		}
+		devices = append(devices, docker.Device{
+			PathOnHost:        s.device.PathOnHost,
+			PathInContainer:   pathInContainer,
+			CgroupPermissions: s.permissions,
+		})
+	}
+	return devices, nil
+}
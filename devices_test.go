@@ -0,0 +1,64 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestDevices() {
+	nics := []client.Nic{
+		{
+			Name:    "test",
+			Network: s.Bridge,
+			Mac:     "13:7D:DA:F2:ED:63",
+		},
+	}
+
+	tests := []struct {
+		description         string
+		metadata            map[string]string
+		expectedCode        mdocker.ErrorCode
+		expectedPermissions string
+	}{
+		{"default devices",
+			nil, 0, "rwm"},
+		{"no devices",
+			map[string]string{mdocker.DevicesMetadataKey: ""}, 0, ""},
+		{"narrowed permissions",
+			map[string]string{mdocker.DevicesMetadataKey: "zfs:r"}, 0, "r"},
+		{"device not allowed",
+			map[string]string{mdocker.DevicesMetadataKey: "fuse"}, mdocker.ErrorCodePolicyViolation, ""},
+		{"invalid permissions",
+			map[string]string{mdocker.DevicesMetadataKey: "zfs:rx"}, mdocker.ErrorCodeValidation, ""},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		guest := &client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID, Metadata: test.metadata}
+		rpcErr := s.rpcError("MDocker.CreateContainer", &rpc.GuestRequest{Guest: guest})
+		if test.expectedCode != 0 {
+			if s.NotNil(rpcErr, msg("should fail")) {
+				s.Equal(test.expectedCode, rpcErr.Code, msg("unexpected error code"))
+			}
+			continue
+		}
+		if !s.Nil(rpcErr, msg("should succeed")) {
+			continue
+		}
+		s.ContainerIDs = append(s.ContainerIDs, guest.ID)
+		container, err := s.Docker.InspectContainer(guest.ID)
+		if !s.NoError(err, msg("should create a container")) {
+			continue
+		}
+		if test.expectedPermissions == "" {
+			s.Empty(container.HostConfig.Devices, msg("should have no devices"))
+			continue
+		}
+		if s.Len(container.HostConfig.Devices, 1, msg("should have the device")) {
+			s.Equal("/dev/zfs", container.HostConfig.Devices[0].PathInContainer, msg("unexpected device"))
+			s.Equal(test.expectedPermissions, container.HostConfig.Devices[0].CgroupPermissions, msg("unexpected permissions"))
+		}
+	}
+}
@@ -7,6 +7,21 @@ HTTP API Endpoint
     /_mistify_RPC_
         * GET - Run a specified method
 
+    /containers/{id}/console
+        * GET - Attach to a container's console over a WebSocket
+
+    /containers/{id}/logs
+        * GET - Stream a container's logs as plain text
+
+    /metrics
+        * GET - Prometheus metrics
+
+    /healthz
+        * GET - Liveness, based on whether docker is reachable
+
+    /readyz
+        * GET - Readiness, based on docker, ovs, the image service and devices
+
 Request Structure
 
     {
@@ -33,19 +48,290 @@ Response Structure
 Where KEY is a string (e.g. "snapshot") and DATA is one of the response structs
 defined in http://godoc.org/github.com/mistifyio/mistify-agent/rpc .
 
+Request IDs
+
+Every request is tagged with a correlation ID, taken from its X-Request-ID
+header if it has one of up to 128 printable characters, or generated
+otherwise. The ID is returned in the X-Request-ID response header, added to
+the data of error objects as "requestId", included in the log entries and
+audit log entry for the request, and sent along in the X-Request-ID header of
+the docker and image service calls made for it.
+
+Audit Log
+
+When an audit log path is configured, every mutating RPC call, i.e. anything
+other than List and Get methods, is appended to it as a line of JSON with the
+time, request ID, caller identity (the authorization policy user, or else the
+client certificate's common name), remote address, method, guest or image id,
+params, outcome, error code and message, and duration in seconds. The outcome is
+success, error, or denied for calls rejected by the authorization policy.
+Console sessions are audited too, as ConsoleAttach or ConsoleExec with the guest
+id and command, once the session ends. Params named password, passphrase,
+secret, token, identityToken, registryToken, credential, credentials, auth,
+authorization, apiKey, privateKey or env, in any case, are redacted. The file is
+rotated to PATH.1, PATH.2, etc. when it would grow past the max size, 100MB by
+default, keeping 5 rotated files by default.
+
+Errors
+
+Failed calls have a null result and an error object with a stable numeric code,
+a message, and, for some codes, structured data:
+
+    {
+        "result": null,
+        "error": {
+            "code": 2,
+            "message": "No such container: 5f9a...",
+            "data": {
+                "id": "5f9a...",
+                "requestId": "8c1e..."
+            }
+        },
+        "id": 0
+    }
+
+The codes are:
+
+    1 - internal, for errors that fit no other code
+    2 - not found, e.g. no such container
+    3 - already exists, e.g. a container with the same id
+    4 - invalid state, e.g. pausing a stopped container
+    5 - network failure, e.g. an ovs command failing
+    6 - image unavailable, from docker or the image service
+    7 - dependency unavailable, e.g. docker being down
+    8 - validation, for missing or invalid request fields
+    9 - unauthorized
+    10 - policy violation, for guests that would loosen the security policy
+
+Guest States
+
+A guest is in one of the states created, running, paused, stopped, deleted or
+error. The methods that change state check that the change is valid from the
+guest's current state before doing anything, so pausing a stopped guest fails
+with an invalid state error. They then wait for docker to reach the new state,
+failing with the actual state if it doesn't within 10 seconds.
+GetContainerState returns a guest's state, optionally waiting for it to reach
+a given one first.
+
+Managed Containers and Images
+
+Containers created by CreateContainer and CloneContainer, images loaded by
+LoadImage and images saved by SaveContainer are labeled io.mistify.managed-by=
+mistify-agent-docker, along with their kind, guest id, image service id and
+creation time. ListContainers and ListImages only return managed containers
+and images, unless "includeUnmanaged" is set to true in the ListContainers opts
+or the ListImages request. Containers and images from before the labels were
+added are still treated as managed if their name or repository is a uuid, as
+the agent named them, so other containers and images shouldn't be given uuid
+names. Images whose archives have no config file the agent recognizes, such
+as OCI layout archives, can't be labeled; an error is logged and they are
+likewise only recognized by their uuid repository.
+
+Guests
+
+GetGuest and ListGuests return guests in the mistify-agent's own model rather
+than docker's. The guest type, cpus, nics and metadata are kept in container
+labels when a guest is created, and combined with the image, memory and state
+from docker. While a guest is running, each nic's device is the name of its
+OVS port. ListGuests returns all managed guests, in any state.
+
+Security Policy
+
+The security policy in the config applies to every new guest: capabilities to
+add and drop, seccomp and AppArmor profiles, no-new-privileges, a read-only
+root filesystem, a pids limit and the highest ulimits a guest may have. Guest
+metadata can tighten the policy with the keys capDrop, noNewPrivileges,
+readOnlyRootfs, pidsLimit and ulimits (NAME=SOFT[:HARD], comma separated), but
+not loosen it. CreateContainer rejects guests that would, such as ones adding a
+capability the policy doesn't, raising a limit or turning off a required flag,
+with a policy violation error naming the setting and the reason.
+
+Devices
+
+Host devices are only passed through to guests from the device allowlist in
+the config. Each device has a name, host and container paths, and the most
+cgroup permissions (a combination of r, w and m) guests may have. A guest
+selects devices by name in its "devices" metadata, e.g. "zfs,fuse:rw", where
+the permissions may be narrowed but not widened. Guests without the key get
+the devices marked as default; an empty value gives none. By default the
+allowlist only has /dev/zfs, named zfs, which is a default device.
+
+Published Ports
+
+Guests are normally only reachable over their OVS interfaces. Host ports can be
+forwarded to a guest by listing them in the guest's "ports" metadata as comma
+separated HOST_PORT:GUEST_PORT[/PROTOCOL] entries, e.g. "8080:80,5353:53/udp".
+The protocol is tcp or udp and defaults to tcp. Traffic addressed to the host
+itself is forwarded with iptables DNAT rules to the address of the guest's first
+nic, which must be set, and accepted in the FORWARD chain. The rules are added
+when the guest starts and removed when it stops. Creating a guest fails if
+another guest has already published one of its host ports or something on the
+host, such as sshd or the agent, is listening on one.
+
+Snapshots
+
+Snapshots commit a guest's container to an image in the repository
+mistify-snapshot/GUEST_ID, tagged with the snapshot name and labeled with the
+guest id. RollbackSnapshot replaces a guest's container, which must not be
+running, with one created from a snapshot, keeping the guest id, hostname, MAC
+address and the rest of the container's configuration. If a rollback is
+interrupted, e.g. by the agent stopping, the next rollback of the guest
+restores or removes the container it moved aside. Snapshots are not removed
+when their guest is deleted.
+
+Clones
+
+CloneContainer commits a guest's container to an image in the repository
+mistify-clone/NEW_GUEST_ID and creates a new guest from it. The new guest gets
+the id, nics and metadata given in the request, but otherwise the original's
+configuration and resource settings. Like any new guest, its security settings
+and devices come from the current host policy and device allowlist and its own
+metadata, not from the original. The image is removed if the new container
+can't be created.
+
+Exports
+
+ExportContainer writes a guest's filesystem, as a tar archive produced by
+docker export, to a file in the configured export directory or uploads it to
+the image service, optionally gzipped. The path of an export is a plain file
+name within the export directory; other paths, existing files and symlinks are
+rejected, and exports to a path are refused if no export directory is
+configured. The export runs as a background job and the request returns the job
+immediately. GetJob reports the job's state and, once completed, the
+destination, size and sha256 checksum of what was written. CancelJob stops a
+running job. Exports to a path are written to a new NAME.partial file and only
+linked into place once complete, never replacing an existing file. Finished
+jobs are kept for 24 hours.
+
+Console
+
+The console endpoint upgrades to a WebSocket attached to the container's
+stdin/stdout/stderr. If one or more "cmd" query parameters are given, an
+interactive exec instance with a TTY running that command is attached to
+instead. Binary messages carry stdin and output. Text messages are control
+messages; the only one currently understood is a terminal resize:
+
+    {
+        "type": "resize",
+        "width": 80,
+        "height": 24
+    }
+
+Closing the WebSocket detaches from the container without stopping it.
+
+Logs
+
+The logs endpoint accepts the query parameters stdout, stderr, timestamps and
+follow (each "true" to enable), tail (number of lines) and since/until
+(RFC3339 timestamps). With follow=true the response stays open and new output
+is streamed as the container logs it.
+
+Health
+
+The health and readiness endpoints respond 200 when their checks pass and 503
+otherwise, with the result of each check in the body. Check results are cached
+for a few seconds.
+
+    {
+        "ok": false,
+        "checks": {
+            "docker": {"ok": true, "checkedAt": "..."},
+            "ovs": {"ok": false, "error": "...", "checkedAt": "..."}
+        }
+    }
+
+Docker Availability
+
+The connection to the docker daemon is monitored in the background. While the
+daemon is unreachable, RPC methods, the console and logs endpoints, and new
+event subscriptions fail immediately with a "docker unavailable" error rather
+than hanging, and reconnection is retried with backoff. Docker event listeners are resubscribed once the daemon is back.
+
+Configuration
+
+NewWithConfig creates an MDocker from a Config, which LoadConfig reads from a
+YAML file with MDOCKER_ environment variable overrides. Resource limits give
+new guests a default amount of memory and cap the memory and cpus they may
+request. The network backend is either "ovs", or "none" to leave guests
+without network interfaces. The image service and resource limits can be
+changed at runtime with Reconfigure, as can the security policy and device
+allowlist.
+
+Listening
+
+By default the server listens on all interfaces. It can instead be bound to a
+specific address, listen on a unix socket with configurable permissions, or
+serve on an already open listener such as one passed by systemd socket
+activation. This allows exposing the agent only to the local mistify-agent.
+
+TLS
+
+The server can serve TLS, optionally requiring clients to present a
+certificate signed by a configured CA. The certificate, key and CA files are
+reloaded when they change on disk, so certificates can be rotated without a
+restart.
+
+Authorization
+
+When an authorization policy is configured, every RPC call and console/logs
+request must come from a known caller, identified by an "Authorization:
+Bearer TOKEN" header or by the common name of its tls client certificate.
+Each caller has one of three roles, each including the access of the ones
+before it:
+
+    read-only - GetInfo and the List and Get methods below, and logs
+    operator  - starting, stopping, restarting, pausing and unpausing guests
+    admin     - everything else, including creating and deleting guests,
+                image management, exec and the console
+
+Any other method, including ones added in later versions, requires admin
+unless the policy says otherwise. The role required by a specific method can be
+overridden in the policy:
+
+    {
+        "users": [
+            {"name": "mistify-agent", "role": "admin"},
+            {"name": "monitor", "token": "SECRET", "role": "read-only"}
+        ],
+        "methods": {
+            "MDocker.ExecContainer": "operator"
+        }
+    }
+
+The metrics and health endpoints do not require authorization.
+
 RPC Methods
 
+    ListGuests
+    GetGuest
+
     ListContainers
     GetContainer
     DeleteContainer
     SaveContainer
     CreateContainer
+    CloneContainer
     StartContainer
     StopContainer
     RestartContainer
     RebootContainer
     PauseContainer
     UnpauseContainer
+    UpdateContainer
+    ExecContainer
+    GetContainerLogs
+    GetContainerStats
+    GetContainerState
+
+    CreateSnapshot
+    ListSnapshots
+    DeleteSnapshot
+    RollbackSnapshot
+
+    ExportContainer
+    GetJob
+    ListJobs
+    CancelJob
 
     ListImages
     GetImages
@@ -0,0 +1,19 @@
+package mdocker
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// ErrorDockerUnavailable is returned for any docker call made while the
+	// connection to the docker daemon is down
+	ErrorDockerUnavailable struct {
+		Since time.Time
+	}
+)
+
+// Error returns a string error message
+func (e ErrorDockerUnavailable) Error() string {
+	return fmt.Sprintf("docker unavailable since %s", e.Since.Format(time.RFC3339))
+}
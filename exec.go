@@ -0,0 +1,172 @@
+package mdocker
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// Defaults used when an exec request doesn't specify its own limits
+	execDefaultTimeout   = 30 * time.Second
+	execDefaultMaxOutput = 1024 * 1024
+)
+
+type (
+	// ExecRequest is a request to run a command inside a running container
+	ExecRequest struct {
+		ID         string   `json:"id"`
+		Cmd        []string `json:"cmd"`
+		Env        []string `json:"env,omitempty"`
+		User       string   `json:"user,omitempty"`
+		WorkingDir string   `json:"workingDir,omitempty"`
+		// Timeout is the maximum number of seconds to wait for the command
+		Timeout uint `json:"timeout,omitempty"`
+		// MaxOutput is the maximum number of bytes captured per output stream
+		MaxOutput uint `json:"maxOutput,omitempty"`
+	}
+
+	// ExecResponse is the result of a command run inside a container
+	ExecResponse struct {
+		ExecID    string `json:"execId"`
+		ExitCode  int    `json:"exitCode"`
+		Stdout    string `json:"stdout"`
+		Stderr    string `json:"stderr"`
+		Truncated bool   `json:"truncated"`
+	}
+
+	// limitedBuffer captures writes up to a maximum size, silently discarding
+	// anything beyond it so the writer on the other end never blocks
+	limitedBuffer struct {
+		mutex     sync.Mutex
+		max       int
+		buf       []byte
+		truncated bool
+	}
+)
+
+func newLimitedBuffer(max int) *limitedBuffer {
+	return &limitedBuffer{
+		max: max,
+		buf: make([]byte, 0, 512),
+	}
+}
+
+// Write appends as much of p as fits in the buffer
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	remaining := b.max - len(b.buf)
+	if remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf = append(b.buf, p[:remaining]...)
+		}
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// String returns the captured output
+func (b *limitedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.buf)
+}
+
+// Truncated returns whether any output was discarded
+func (b *limitedBuffer) Truncated() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.truncated
+}
+
+// ExecContainer runs a command inside a running Docker container, capturing
+// its output and exit code
+func (md *MDocker) ExecContainer(h *http.Request, request *ExecRequest, response *ExecResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if len(request.Cmd) == 0 {
+		return ErrorValidation{Message: "missing cmd"}
+	}
+
+	timeout := execDefaultTimeout
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Second
+	}
+	maxOutput := execDefaultMaxOutput
+	if request.MaxOutput > 0 {
+		maxOutput = int(request.MaxOutput)
+	}
+
+	createOpts := docker.CreateExecOptions{
+		Container:    request.ID,
+		Cmd:          request.Cmd,
+		Env:          request.Env,
+		User:         request.User,
+		WorkingDir:   request.WorkingDir,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	exec, err := md.client.CreateExec(createOpts)
+	if err != nil {
+		return err
+	}
+
+	stdout := newLimitedBuffer(maxOutput)
+	stderr := newLimitedBuffer(maxOutput)
+	startOpts := docker.StartExecOptions{
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+	}
+	if err := md.checkDocker(); err != nil {
+		return err
+	}
+	start := time.Now()
+	closeWaiter, err := md.client.StartExecNonBlocking(exec.ID, startOpts)
+	observeDockerStream(h.Context(), http.MethodPost, "/exec/{id}/start", start)
+	if err != nil {
+		return err
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- closeWaiter.Wait()
+	}()
+
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			return err
+		}
+	case <-time.After(timeout):
+		// Docker has no way to kill an exec instance, so the best that can be
+		// done is to stop waiting on it
+		if err := closeWaiter.Close(); err != nil {
+			logger(h.Context()).WithFields(log.Fields{
+				"error":  err,
+				"execID": exec.ID,
+			}).Error("failed to close exec stream")
+		}
+		return fmt.Errorf("exec timed out after %s", timeout)
+	}
+
+	inspect, err := md.client.InspectExec(exec.ID)
+	if err != nil {
+		return err
+	}
+
+	response.ExecID = exec.ID
+	response.ExitCode = inspect.ExitCode
+	response.Stdout = stdout.String()
+	response.Stderr = stderr.String()
+	response.Truncated = stdout.Truncated() || stderr.Truncated()
+	return nil
+}
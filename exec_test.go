@@ -0,0 +1,48 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+)
+
+func (s *ContainerTestSuite) TestExecContainer() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	tests := []struct {
+		description string
+		request     *mdocker.ExecRequest
+		expectedErr bool
+		exitCode    int
+		stdout      string
+		truncated   bool
+	}{
+		{"missing id",
+			&mdocker.ExecRequest{Cmd: []string{"true"}}, true, 0, "", false},
+		{"missing cmd",
+			&mdocker.ExecRequest{ID: guest.ID}, true, 0, "", false},
+		{"invalid id",
+			&mdocker.ExecRequest{ID: "asdf", Cmd: []string{"true"}}, true, 0, "", false},
+		{"valid request",
+			&mdocker.ExecRequest{ID: guest.ID, Cmd: []string{"echo", "foo"}}, false, 0, "foo\n", false},
+		{"nonzero exit",
+			&mdocker.ExecRequest{ID: guest.ID, Cmd: []string{"false"}}, false, 1, "", false},
+		{"truncated output",
+			&mdocker.ExecRequest{ID: guest.ID, Cmd: []string{"echo", "foobar"}, MaxOutput: 3}, false, 0, "foo", true},
+		{"timeout",
+			&mdocker.ExecRequest{ID: guest.ID, Cmd: []string{"sleep", "5"}, Timeout: 1}, true, 0, "", false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &mdocker.ExecResponse{}
+		err := s.Client.Do("MDocker.ExecContainer", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+		} else {
+			s.NoError(err, msg("should succeed"))
+			s.Equal(test.exitCode, response.ExitCode, msg("should return exit code"))
+			s.Equal(test.stdout, response.Stdout, msg("should capture stdout"))
+			s.Equal(test.truncated, response.Truncated, msg("should report truncation"))
+		}
+	}
+}
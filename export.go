@@ -0,0 +1,262 @@
+package mdocker
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	netutil "github.com/mistifyio/util/net"
+)
+
+// exportJobType is the job type of container exports
+const exportJobType = "export"
+
+type (
+	// ExportRequest is a request to export a guest's filesystem. Exactly one
+	// of Path and Upload must be set.
+	ExportRequest struct {
+		// ID is the guest id
+		ID string `json:"id"`
+		// Path is the name of the file in the agent's export directory to
+		// write the export to
+		Path string `json:"path"`
+		// Upload sends the export to the image service instead of a file
+		Upload bool `json:"upload"`
+		// Compress gzips the export
+		Compress bool   `json:"compress"`
+		Comment  string `json:"comment"`
+	}
+
+	// ExportResult is the result of a completed export job
+	ExportResult struct {
+		// Destination is the file path or upload url
+		Destination string `json:"destination"`
+		// Size is the number of bytes written, after compression
+		Size int64 `json:"size"`
+		// Checksum is the hex encoded sha256 of the bytes written
+		Checksum string `json:"checksum"`
+	}
+
+	// countingWriter counts the bytes written through it
+	countingWriter struct {
+		count int64
+	}
+)
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// validate checks the request fields
+func (r *ExportRequest) validate() error {
+	if r.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if (r.Path == "") == !r.Upload {
+		return ErrorValidation{Message: "exactly one of path and upload must be set"}
+	}
+	if r.Path != "" {
+		name := filepath.Clean(r.Path)
+		if name != r.Path || name != filepath.Base(name) || name == "." || name == ".." {
+			return ErrorValidation{Message: "path must be a file name"}
+		}
+	}
+	return nil
+}
+
+// exportPath returns the file an export to a path is written to, in the
+// export directory
+func (md *MDocker) exportPath(name string) (string, error) {
+	dir := md.getExportDir()
+	if dir == "" {
+		return "", ErrorValidation{Message: "exports to a path are disabled"}
+	}
+	dest := filepath.Join(dir, name)
+	// Lstat so a symlink left in the export directory counts as existing
+	if _, err := os.Lstat(dest); err == nil {
+		return "", ErrorAlreadyExists{Kind: "export", ID: name}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return dest, nil
+}
+
+// ExportContainer starts a background job that exports a guest's filesystem
+// as a tar archive to a file in the export directory or the image service.
+// The job can be followed with GetJob and stopped with CancelJob.
+func (md *MDocker) ExportContainer(h *http.Request, request *ExportRequest, response *JobResponse) error {
+	if err := request.validate(); err != nil {
+		return err
+	}
+	container, err := md.client.InspectContainerWithContext(request.ID, h.Context())
+	if err != nil {
+		return err
+	}
+
+	exportRequest := *request
+	exportRequest.ID = container.ID
+	if request.Path != "" {
+		exportRequest.Path, err = md.exportPath(request.Path)
+		if err != nil {
+			return err
+		}
+	}
+	job := md.jobs.start(h.Context(), exportJobType, container.ID, func(ctx context.Context) (interface{}, error) {
+		if exportRequest.Upload {
+			return md.exportToImageService(ctx, &exportRequest)
+		}
+		return md.exportToFile(ctx, &exportRequest)
+	})
+	response.Jobs = []*Job{job}
+	return nil
+}
+
+// exportTo streams a container export into a writer, compressing it if
+// requested, and returns the size and checksum of the bytes written
+func (md *MDocker) exportTo(ctx context.Context, request *ExportRequest, dest io.Writer) (*ExportResult, error) {
+	hash := sha256.New()
+	counter := &countingWriter{}
+	var output io.Writer = io.MultiWriter(dest, hash, counter)
+
+	var gzipWriter *gzip.Writer
+	if request.Compress {
+		gzipWriter = gzip.NewWriter(output)
+		output = gzipWriter
+	}
+
+	opts := docker.ExportContainerOptions{
+		ID:           request.ID,
+		OutputStream: output,
+		Context:      ctx,
+	}
+	if err := md.checkDocker(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	err := md.client.ExportContainer(opts)
+	observeDockerStream(ctx, http.MethodGet, "/containers/{id}/export", start)
+	if err != nil {
+		logger(ctx).WithFields(log.Fields{
+			"error": err,
+			"id":    request.ID,
+			"func":  "client.ExportContainer",
+		}).Error("failed to export container")
+		return nil, err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ExportResult{
+		Size:     counter.count,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// exportToFile writes an export to a local file. The export is written to a
+// new temporary file next to the destination, which is only linked into place
+// once complete, so neither an existing file nor a symlink is ever written
+// through or replaced.
+func (md *MDocker) exportToFile(ctx context.Context, request *ExportRequest) (*ExportResult, error) {
+	partial := request.Path + ".partial"
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := md.exportTo(ctx, request, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Link(partial, request.Path)
+	}
+	if removeErr := os.Remove(partial); removeErr != nil {
+		logger(ctx).WithFields(log.Fields{
+			"error": removeErr,
+			"file":  partial,
+		}).Error("failed to remove partial export")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Destination = request.Path
+	return result, nil
+}
+
+// exportToImageService uploads an export to the image service. The export is
+// streamed, so its size and checksum are only known once the upload is done.
+func (md *MDocker) exportToImageService(ctx context.Context, request *ExportRequest) (*ExportResult, error) {
+	hostport, err := netutil.HostWithPort(md.getImageService())
+	if err != nil {
+		return nil, err
+	}
+	dest := fmt.Sprintf("http://%s/images", hostport)
+
+	pipeReader, pipeWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dest, pipeReader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	if request.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	// The image service uses these to describe the new image
+	req.Header.Set("X-Image-Type", "container")
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	req.Header.Set("X-Image-Source", request.ID)
+	if request.Comment != "" {
+		req.Header.Set("X-Image-Comment", request.Comment)
+	}
+
+	var result *ExportResult
+	exportDone := make(chan error, 1)
+	go func() {
+		var err error
+		result, err = md.exportTo(ctx, request, pipeWriter)
+		// Closing with a nil error is a normal close
+		_ = pipeWriter.CloseWithError(err)
+		exportDone <- err
+	}()
+
+	resp, err := http.DefaultClient.Do(req)
+	// Unblock the export if the image service responded without reading all
+	// of it
+	_ = pipeReader.Close()
+	exportErr := <-exportDone
+	if err != nil {
+		return nil, err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	if exportErr != nil {
+		return nil, exportErr
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, ErrorHTTPCode{
+			Expected: http.StatusOK,
+			Code:     resp.StatusCode,
+			Source:   dest,
+		}
+	}
+
+	result.Destination = dest
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package mdocker_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+)
+
+func (s *ContainerTestSuite) jobAction(action string, request interface{}) ([]*mdocker.Job, error) {
+	response := &mdocker.JobResponse{}
+	err := s.Client.Do("MDocker."+action, request, response)
+	return response.Jobs, err
+}
+
+// waitForJob polls a job until it finishes
+func (s *ContainerTestSuite) waitForJob(id string) *mdocker.Job {
+	for i := 0; i < 300; i++ {
+		jobs, err := s.jobAction("GetJob", &mdocker.JobRequest{ID: id})
+		s.Require().NoError(err)
+		if jobs[0].State != mdocker.JobStateRunning {
+			return jobs[0]
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.FailNow("job did not finish")
+	return nil
+}
+
+func (s *ContainerTestSuite) TestExportContainer() {
+	guest := s.createContainer()
+	dir, err := ioutil.TempDir("", "mdocker-export")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	dest := filepath.Join(dir, "export.tar")
+
+	_, err = s.jobAction("ExportContainer", &mdocker.ExportRequest{ID: guest.ID, Path: "export.tar"})
+	s.Error(err, "should fail without an export directory")
+
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.ExportDir = dir
+	s.Require().NoError(s.MDocker.Reconfigure(config))
+	defer func() {
+		config.ExportDir = ""
+		s.NoError(s.MDocker.Reconfigure(config))
+	}()
+
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "existing.tar"), nil, 0600))
+	s.Require().NoError(os.Symlink(filepath.Join(dir, "target"), filepath.Join(dir, "link.tar")))
+
+	tests := []struct {
+		description string
+		request     *mdocker.ExportRequest
+		expectedErr bool
+	}{
+		{"missing id",
+			&mdocker.ExportRequest{Path: "export.tar"}, true},
+		{"missing destination",
+			&mdocker.ExportRequest{ID: guest.ID}, true},
+		{"both destinations",
+			&mdocker.ExportRequest{ID: guest.ID, Path: "export.tar", Upload: true}, true},
+		{"absolute path",
+			&mdocker.ExportRequest{ID: guest.ID, Path: dest}, true},
+		{"parent directory",
+			&mdocker.ExportRequest{ID: guest.ID, Path: "../export.tar"}, true},
+		{"subdirectory",
+			&mdocker.ExportRequest{ID: guest.ID, Path: "foo/export.tar"}, true},
+		{"existing file",
+			&mdocker.ExportRequest{ID: guest.ID, Path: "existing.tar"}, true},
+		{"symlink",
+			&mdocker.ExportRequest{ID: guest.ID, Path: "link.tar"}, true},
+		{"invalid id",
+			&mdocker.ExportRequest{ID: "asdf", Path: "export.tar"}, true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		_, err := s.jobAction("ExportContainer", test.request)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+		} else {
+			s.NoError(err, msg("should succeed"))
+		}
+	}
+
+	jobs, err := s.jobAction("ExportContainer", &mdocker.ExportRequest{ID: guest.ID, Path: "export.tar"})
+	s.Require().NoError(err)
+	s.Require().Len(jobs, 1)
+	s.Equal(guest.ID, jobs[0].Guest)
+
+	job := s.waitForJob(jobs[0].ID)
+	s.Require().Equal(mdocker.JobStateCompleted, job.State, job.Error)
+
+	data, err := ioutil.ReadFile(dest)
+	s.Require().NoError(err)
+	_, err = tar.NewReader(bytes.NewReader(data)).Next()
+	s.NoError(err, "should be a tar archive")
+	sum := sha256.Sum256(data)
+	result, _ := job.Result.(map[string]interface{})
+	s.Equal(hex.EncodeToString(sum[:]), result["checksum"], "should report the checksum")
+	s.EqualValues(len(data), result["size"], "should report the size")
+	s.Equal(dest, result["destination"], "should report the file written")
+
+	_, err = os.Stat(dest + ".partial")
+	s.True(os.IsNotExist(err), "should not leave the partial file")
+	_, err = os.Lstat(filepath.Join(dir, "target"))
+	s.True(os.IsNotExist(err), "should not write through symlinks")
+
+	_, err = s.jobAction("ExportContainer", &mdocker.ExportRequest{ID: guest.ID, Path: "export.tar"})
+	s.Error(err, "should not overwrite a finished export")
+
+	listed, err := s.jobAction("ListJobs", &mdocker.JobRequest{})
+	s.NoError(err)
+	s.NotEmpty(listed, "should list the job")
+}
+
+func (s *ContainerTestSuite) TestCancelJob() {
+	_, err := s.jobAction("CancelJob", &mdocker.JobRequest{})
+	s.Error(err, "should require an id")
+	_, err = s.jobAction("CancelJob", &mdocker.JobRequest{ID: "asdf"})
+	s.Error(err, "should fail for a missing job")
+	_, err = s.jobAction("GetJob", &mdocker.JobRequest{ID: "asdf"})
+	s.Error(err, "should fail for a missing job")
+}
+
+func (s *ContainerTestSuite) TestCloseWaitsForExports() {
+	guest := s.createContainer()
+	dir, err := ioutil.TempDir("", "mdocker-export")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.ExportDir = dir
+	md, err := mdocker.NewWithConfig(config)
+	s.Require().NoError(err)
+	request := &mdocker.ExportRequest{ID: guest.ID, Path: "export.tar"}
+	s.Require().NoError(md.ExportContainer(httptest.NewRequest("POST", "/", nil), request, &mdocker.JobResponse{}))
+	md.Close()
+
+	// Whether or not the export finished first, nothing partial is left
+	partials, err := filepath.Glob(filepath.Join(dir, "*.partial"))
+	s.NoError(err)
+	s.Empty(partials, "should clean up cancelled exports before returning")
+}
@@ -0,0 +1,185 @@
+package mdocker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// Labels recording the parts of a guest docker doesn't keep track of, so the
+// guest can be reconstructed from its container
+const (
+	guestLabelPrefix   = "io.mistify.guest."
+	guestTypeLabel     = guestLabelPrefix + "type"
+	guestCPULabel      = guestLabelPrefix + "cpu"
+	guestNicsLabel     = guestLabelPrefix + "nics"
+	guestMetadataLabel = guestLabelPrefix + "metadata"
+)
+
+type (
+	// GuestsResponse is a list of guests
+	GuestsResponse struct {
+		Guests []*client.Guest `json:"guests"`
+	}
+)
+
+// guestLabels returns the labels for a new guest's container
+func guestLabels(guest *client.Guest) (map[string]string, error) {
+	labels := managedLabels(kindGuest, guest.ID, guest.Image)
+	labels[guestTypeLabel] = guest.Type
+	labels[guestCPULabel] = strconv.FormatUint(uint64(guest.CPU), 10)
+	nics, err := json.Marshal(guest.Nics)
+	if err != nil {
+		return nil, err
+	}
+	labels[guestNicsLabel] = string(nics)
+	if len(guest.Metadata) > 0 {
+		metadata, err := json.Marshal(guest.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		labels[guestMetadataLabel] = string(metadata)
+	}
+	return labels, nil
+}
+
+// guestFromContainer reconstructs a guest from its container's labels and
+// inspect data. Containers created before the labels existed only have the
+// fields docker knows about.
+func guestFromContainer(ctx context.Context, container *docker.Container) *client.Guest {
+	guest := &client.Guest{
+		ID:    strings.TrimPrefix(container.Name, "/"),
+		Type:  "container",
+		State: guestState(container.State),
+	}
+
+	var labels map[string]string
+	if container.Config != nil {
+		labels = container.Config.Labels
+		guest.Image = container.Config.Image
+		guest.Memory = uint(container.Config.Memory / 1024 / 1024) // Convert bytes to MB
+	}
+	// The memory limit moved to the host config in later docker versions,
+	// and UpdateContainer changes it there
+	if container.HostConfig != nil && container.HostConfig.Memory != 0 {
+		guest.Memory = uint(container.HostConfig.Memory / 1024 / 1024)
+	}
+	if image := labels[ImageLabel]; image != "" {
+		guest.Image = image
+	}
+	if guestType := labels[guestTypeLabel]; guestType != "" {
+		guest.Type = guestType
+	}
+	if cpu, err := strconv.ParseUint(labels[guestCPULabel], 10, 0); err == nil {
+		guest.CPU = uint(cpu)
+	}
+
+	for label, dest := range map[string]interface{}{
+		guestNicsLabel:     &guest.Nics,
+		guestMetadataLabel: &guest.Metadata,
+	} {
+		value := labels[label]
+		if value == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(value), dest); err != nil {
+			logger(ctx).WithFields(log.Fields{
+				"error": err,
+				"guest": guest.ID,
+				"label": label,
+			}).Error("invalid guest label")
+		}
+	}
+	return guest
+}
+
+// setNicDevices fills in the OVS port names of a guest's nics. Ports only
+// exist while the guest is running.
+func (md *MDocker) setNicDevices(ctx context.Context, guest *client.Guest) {
+	if guest.State != GuestStateRunning || len(guest.Nics) == 0 {
+		return
+	}
+	nicStats, err := md.network.interfaceStatistics(ctx, guest.ID)
+	if err != nil {
+		// The rest of the guest is still useful
+		logger(ctx).WithFields(log.Fields{
+			"error": err,
+			"guest": guest.ID,
+		}).Warning("failed to look up guest ports")
+		return
+	}
+	ports := make(map[string]string, len(nicStats))
+	for _, nic := range nicStats {
+		ports[nic.Name] = nic.Port
+	}
+	for i := range guest.Nics {
+		guest.Nics[i].Device = ports[guest.Nics[i].Name]
+	}
+}
+
+// getGuest looks up a guest by id
+func (md *MDocker) getGuest(ctx context.Context, id string) (*client.Guest, error) {
+	container, err := md.client.InspectContainerWithContext(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	guest := guestFromContainer(ctx, container)
+	md.setNicDevices(ctx, guest)
+	return guest, nil
+}
+
+// ListGuests retrieves all guests created by the agent, sorted by id
+func (md *MDocker) ListGuests(h *http.Request, request *struct{}, response *GuestsResponse) error {
+	opts := docker.ListContainersOptions{
+		All:     true,
+		Context: h.Context(),
+	}
+	apiContainers, err := md.client.ListContainers(opts)
+	if err != nil {
+		return err
+	}
+
+	guests := make([]*client.Guest, 0, len(apiContainers))
+	for _, apiContainer := range apiContainers {
+		if !isManagedContainer(apiContainer) {
+			continue
+		}
+		guest, err := md.getGuest(h.Context(), apiContainer.ID)
+		if err != nil {
+			// The container may have been removed since it was listed
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				continue
+			}
+			return err
+		}
+		guests = append(guests, guest)
+	}
+	sort.Slice(guests, func(i, j int) bool {
+		return guests[i].ID < guests[j].ID
+	})
+
+	response.Guests = guests
+	return nil
+}
+
+// GetGuest retrieves a guest by id
+func (md *MDocker) GetGuest(h *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	containerName, err := requestContainerName(request)
+	if err != nil {
+		return err
+	}
+	guest, err := md.getGuest(h.Context(), containerName)
+	if err != nil {
+		return err
+	}
+	response.Guest = guest
+	return nil
+}
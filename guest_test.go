@@ -0,0 +1,61 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestGetGuest() {
+	guest := s.createContainer()
+
+	tests := []struct {
+		description string
+		request     *rpc.GuestRequest
+		expectedErr bool
+	}{
+		{"missing guest",
+			&rpc.GuestRequest{}, true},
+		{"invalid id",
+			&rpc.GuestRequest{Guest: &client.Guest{ID: uuid.New()}}, true},
+		{"valid",
+			&rpc.GuestRequest{Guest: &client.Guest{ID: guest.ID}}, false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &rpc.GuestResponse{}
+		err := s.Client.Do("MDocker.GetGuest", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if !s.NoError(err, msg("should succeed")) {
+			continue
+		}
+		s.Equal(guest.ID, response.Guest.ID, msg("unexpected id"))
+		s.Equal(s.ImageID, response.Guest.Image, msg("unexpected image"))
+		s.Equal(guest.Memory, response.Guest.Memory, msg("unexpected memory"))
+		s.Equal(mdocker.GuestStateCreated, response.Guest.State, msg("unexpected state"))
+		if s.Len(response.Guest.Nics, 1, msg("should have the nics")) {
+			s.Equal(guest.Nics[0].Mac, response.Guest.Nics[0].Mac, msg("unexpected mac"))
+			s.Equal(guest.Nics[0].VLANs, response.Guest.Nics[0].VLANs, msg("unexpected vlans"))
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestListGuests() {
+	guest := s.createContainer()
+
+	response := &mdocker.GuestsResponse{}
+	s.Require().NoError(s.Client.Do("MDocker.ListGuests", &struct{}{}, response))
+	found := false
+	for _, g := range response.Guests {
+		if g.ID == guest.ID {
+			found = true
+			s.Equal(guest.Nics[0].Network, g.Nics[0].Network, "should have the nics")
+		}
+	}
+	s.True(found, "should list the guest")
+}
@@ -0,0 +1,187 @@
+package mdocker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	netutil "github.com/mistifyio/util/net"
+)
+
+const (
+	// HealthPath is the path of the liveness endpoint
+	HealthPath = "/healthz"
+	// ReadyPath is the path of the readiness endpoint
+	ReadyPath = "/readyz"
+
+	// healthCacheTTL is how long a check result is reused before the check
+	// is run again
+	healthCacheTTL = 10 * time.Second
+	// healthCheckTimeout bounds how long a single check may take
+	healthCheckTimeout = 5 * time.Second
+)
+
+type (
+	// HealthCheck is the result of a single dependency check
+	HealthCheck struct {
+		OK        bool      `json:"ok"`
+		Error     string    `json:"error,omitempty"`
+		CheckedAt time.Time `json:"checkedAt"`
+	}
+
+	// HealthStatus is the response body of the health and readiness endpoints
+	HealthStatus struct {
+		OK     bool                    `json:"ok"`
+		Checks map[string]*HealthCheck `json:"checks"`
+	}
+
+	// dependencyCheck is a named check of something the agent relies on
+	dependencyCheck struct {
+		name string
+		// liveness checks must pass for the agent to be considered alive.
+		// All checks must pass for it to be considered ready.
+		liveness bool
+		check    func(ctx context.Context) error
+	}
+
+	// healthChecker runs dependency checks and caches their results
+	healthChecker struct {
+		mutex   sync.Mutex
+		checks  []*dependencyCheck
+		results map[string]*HealthCheck
+	}
+)
+
+func newHealthChecker(checks ...*dependencyCheck) *healthChecker {
+	return &healthChecker{
+		checks:  checks,
+		results: make(map[string]*HealthCheck, len(checks)),
+	}
+}
+
+// status runs any checks whose cached results are stale and returns the
+// results of the selected checks
+func (hc *healthChecker) status(livenessOnly bool) *HealthStatus {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	var resultsMutex sync.Mutex
+	for _, dc := range hc.checks {
+		if livenessOnly && !dc.liveness {
+			continue
+		}
+		if result, ok := hc.results[dc.name]; ok && time.Since(result.CheckedAt) < healthCacheTTL {
+			continue
+		}
+
+		wg.Add(1)
+		go func(dc *dependencyCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+
+			result := &HealthCheck{OK: true}
+			if err := dc.check(ctx); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"check": dc.name,
+				}).Warning("health check failed")
+				result.OK = false
+				result.Error = err.Error()
+			}
+			result.CheckedAt = time.Now()
+
+			resultsMutex.Lock()
+			hc.results[dc.name] = result
+			resultsMutex.Unlock()
+		}(dc)
+	}
+	wg.Wait()
+
+	status := &HealthStatus{
+		OK:     true,
+		Checks: make(map[string]*HealthCheck),
+	}
+	for _, dc := range hc.checks {
+		if livenessOnly && !dc.liveness {
+			continue
+		}
+		result := hc.results[dc.name]
+		status.Checks[dc.name] = result
+		if !result.OK {
+			status.OK = false
+		}
+	}
+	return status
+}
+
+// healthChecks returns the dependency checks for an MDocker
+func (md *MDocker) healthChecks() []*dependencyCheck {
+	checks := []*dependencyCheck{
+		{
+			name:     "docker",
+			liveness: true,
+			// Ping directly rather than reporting the supervisor's view, so
+			// the check is current
+			check: md.supervisor.ping,
+		},
+		{
+			name: "imageService",
+			check: func(ctx context.Context) error {
+				hostport, err := netutil.HostWithPort(md.getImageService())
+				if err != nil {
+					return err
+				}
+				var dialer net.Dialer
+				conn, err := dialer.DialContext(ctx, "tcp", hostport)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			},
+		},
+		{
+			name: "devices",
+			// Every allowed device should exist, so guests can be given it
+			check: func(ctx context.Context) error {
+				for _, device := range md.getDevices() {
+					if _, err := os.Stat(device.PathOnHost); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+	if ovs, ok := md.network.(ovsNetwork); ok {
+		checks = append(checks, &dependencyCheck{
+			name:  "ovs",
+			check: ovs.check,
+		})
+	}
+	return checks
+}
+
+// healthHandler returns a handler reporting the status of either the liveness
+// checks or all checks, responding 503 if any of them fail
+func (md *MDocker) healthHandler(livenessOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := md.health.status(livenessOnly)
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.OK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger(r.Context()).WithField("error", err).Error("failed to write health status")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package mdocker_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+func (s *MDockerTestSuite) TestHealth() {
+	tests := []struct {
+		description string
+		path        string
+		checks      []string
+	}{
+		{"liveness", mdocker.HealthPath, []string{"docker"}},
+		{"readiness", mdocker.ReadyPath, []string{"docker", "ovs", "imageService", "devices"}},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, test.path))
+		if !s.NoError(err, msg("request should succeed")) {
+			continue
+		}
+		status := &mdocker.HealthStatus{}
+		s.NoError(json.NewDecoder(resp.Body).Decode(status), msg("should return json"))
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+		if status.OK {
+			s.Equal(http.StatusOK, resp.StatusCode, msg("should be ok"))
+		} else {
+			s.Equal(http.StatusServiceUnavailable, resp.StatusCode, msg("should be unavailable"))
+		}
+		s.Len(status.Checks, len(test.checks), msg("should run expected checks"))
+		for _, name := range test.checks {
+			s.Contains(status.Checks, name, msg("should include check %s", name))
+		}
+		if check, ok := status.Checks["docker"]; ok {
+			s.True(check.OK, msg("docker should be reachable"))
+		}
+	}
+}
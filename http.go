@@ -1,6 +1,12 @@
 package mdocker
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -9,9 +15,95 @@ import (
 	"github.com/tylerb/graceful"
 )
 
+// DefaultSocketMode is the permission mode of the unix socket when none is
+// configured
+const DefaultSocketMode os.FileMode = 0660
+
+type (
+	// HTTPConfig configures the RPC HTTP server. The server listens on the
+	// first of Listener, UnixSocket or Address:Port that is set.
+	HTTPConfig struct {
+		// Address is the host or ip to listen on. Empty means all interfaces.
+		Address string
+		Port    uint
+		// UnixSocket is the path of a unix socket to listen on instead of tcp
+		UnixSocket string
+		// SocketMode is the permission mode of the unix socket
+		SocketMode os.FileMode
+		// Listener is an already open listener, e.g. from systemd socket
+		// activation, to serve on
+		Listener net.Listener
+		// TLS enables TLS when set
+		TLS *TLSConfig
+		// Auth enables role-based authorization of callers when set. Callers
+		// are identified by bearer token or tls client certificate.
+		Auth *AuthPolicy
+		// NoSignalHandling disables stopping the server on SIGINT and
+		// SIGTERM, for callers that handle shutdown themselves
+		NoSignalHandling bool
+	}
+)
+
+// listen opens the configured listener
+func (config HTTPConfig) listen() (net.Listener, error) {
+	if config.Listener != nil {
+		if config.UnixSocket != "" {
+			return nil, errors.New("only one of listener and unix socket may be set")
+		}
+		return config.Listener, nil
+	}
+
+	if config.UnixSocket == "" {
+		return net.Listen("tcp", net.JoinHostPort(config.Address, fmt.Sprintf("%d", config.Port)))
+	}
+
+	// Clean up a socket left behind by an unclean shutdown, but don't
+	// clobber anything else
+	if info, err := os.Lstat(config.UnixSocket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", config.UnixSocket)
+		}
+		if err := os.Remove(config.UnixSocket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", config.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
+	mode := config.SocketMode
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err := os.Chmod(config.UnixSocket, mode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 // RunHTTP creates and runs the RPC HTTP server
 func (md *MDocker) RunHTTP(port uint) (*graceful.Server, error) {
-	s, err := rpc.NewServer(port)
+	return md.RunHTTPWithConfig(HTTPConfig{Port: port})
+}
+
+// RunHTTPWithConfig creates and runs the RPC HTTP server with the provided
+// configuration
+func (md *MDocker) RunHTTPWithConfig(config HTTPConfig) (*graceful.Server, error) {
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		reloader, err := newCertReloader(*config.TLS)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"config": config.TLS,
+			}).Error("failed to load tls files")
+			return nil, err
+		}
+		tlsConfig = reloader.tlsConfig()
+	}
+
+	s, err := rpc.NewServer(config.Port)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -24,17 +116,57 @@ func (md *MDocker) RunHTTP(port uint) (*graceful.Server, error) {
 		}).Error("failed to register mdocker service")
 		return nil, err
 	}
+	// Replace the default codec to return structured errors
+	s.RPCServer.RegisterCodec(jsonCodec{}, "application/json")
+	s.RPCServer.RegisterInterceptFunc(md.interceptRPC)
+	s.RPCServer.RegisterAfterFunc(md.afterRPC)
+
+	var consoleHandler, logsHandler http.Handler
+	consoleHandler = http.HandlerFunc(md.consoleHandler)
+	logsHandler = http.HandlerFunc(md.logsHandler)
+	if config.Auth != nil {
+		// Console access is equivalent to running arbitrary commands
+		consoleHandler = config.Auth.requireRole(RoleAdmin, consoleHandler)
+		logsHandler = config.Auth.requireRole(RoleReadOnly, logsHandler)
+		s.HTTPServer.Handler = config.Auth.rpcAuthorizer(s.HTTPServer.Handler)
+	}
+	consoleHandler = auditConsole(consoleHandler)
+	// Audit outside authorization so denied calls are recorded too
+	s.HTTPServer.Handler = md.auditRequests(s.HTTPServer.Handler)
+	s.HTTPServer.Handler = md.trackOperations(s.HTTPServer.Handler)
+	// Tag every request, including rejected ones, with a correlation ID
+	s.HTTPServer.Handler = requestIDHandler(s.HTTPServer.Handler)
+	s.Handle(ConsolePath, consoleHandler)
+	s.Handle(LogsPath, logsHandler)
+	s.Handle(MetricsPath, md.metricsHandler())
+	s.Handle(HealthPath, md.healthHandler(true))
+	s.Handle(ReadyPath, md.healthHandler(false))
+
+	listener, err := config.listen()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"address":    config.Address,
+			"port":       config.Port,
+			"unixSocket": config.UnixSocket,
+		}).Error("failed to listen")
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	server := &graceful.Server{
-		Timeout: 5 * time.Second,
-		Server:  s.HTTPServer,
+		Timeout:          5 * time.Second,
+		Server:           s.HTTPServer,
+		NoSignalHandling: config.NoSignalHandling,
 	}
-	go listenAndServe(server)
+	go serve(server, listener)
 	return server, nil
 }
 
-func listenAndServe(server *graceful.Server) {
-	if err := server.ListenAndServe(); err != nil {
+func serve(server *graceful.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil {
 		// Ignore the error from closing the listener, which is involved in the
 		// graceful shutdown
 		if !strings.Contains(err.Error(), "use of closed network connection") {
@@ -4,11 +4,14 @@ import (
 	"archive/tar"
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"regexp"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,27 +19,55 @@ import (
 	"github.com/mistifyio/mistify-agent/rpc"
 	logx "github.com/mistifyio/mistify-logrus-ext"
 	netutil "github.com/mistifyio/util/net"
-	"github.com/pborman/uuid"
 )
 
-// ListImages retrieves a list of Docker images
-func (md *MDocker) ListImages(h *http.Request, request *rpc.ImageRequest, response *rpc.ImageResponse) error {
-	opts := docker.ListImagesOptions{}
+// imageConfigPattern matches the image config files in a saved image archive,
+// either ID/json in the legacy format or ID.json alongside a manifest. Archives
+// in other layouts, such as OCI blobs, aren't labeled.
+var imageConfigPattern = regexp.MustCompile(`^[0-9a-f]{64}(/json|\.json)$`)
 
+type (
+	// ListImagesRequest is a request to list images
+	ListImagesRequest struct {
+		rpc.ImageRequest
+		// IncludeUnmanaged lists images the agent didn't load or save as
+		// well
+		IncludeUnmanaged bool `json:"includeUnmanaged"`
+	}
+)
+
+// apiImageID returns the id of a listed image, which is its image service id
+// if it has one, otherwise its repository or docker id
+func apiImageID(ai docker.APIImages) string {
+	if id := ai.Labels[ImageLabel]; id != "" {
+		return id
+	}
+	if len(ai.RepoTags) > 0 {
+		if id, _ := docker.ParseRepositoryTag(ai.RepoTags[0]); id != "<none>" {
+			return id
+		}
+	}
+	return ai.ID
+}
+
+// ListImages retrieves a list of the images loaded from the image service or
+// saved from containers, or of all Docker images if requested
+func (md *MDocker) ListImages(h *http.Request, request *ListImagesRequest, response *rpc.ImageResponse) error {
+	opts := docker.ListImagesOptions{Context: h.Context()}
 	apiImages, err := md.client.ListImages(opts)
 	if err != nil {
 		return err
 	}
 	images := make([]*rpc.Image, 0, len(apiImages))
 	for _, ai := range apiImages {
-		id, _ := docker.ParseRepositoryTag(ai.RepoTags[0])
-		if uuid.Parse(id) != nil { // Mistify images are uuid repos
-			images = append(images, &rpc.Image{
-				ID:   id,
-				Type: "container",
-				Size: uint64(ai.Size) / 1024 / 1024,
-			})
+		if !request.IncludeUnmanaged && !isManagedImage(ai) {
+			continue
 		}
+		images = append(images, &rpc.Image{
+			ID:   apiImageID(ai),
+			Type: "container",
+			Size: uint64(ai.Size) / 1024 / 1024,
+		})
 	}
 
 	response.Images = images
@@ -67,11 +98,16 @@ func (md *MDocker) LoadImage(h *http.Request, request *rpc.ImageRequest, respons
 
 	// Check if we already have the image to avoid unnecessary pulling
 	image, err := md.client.InspectImage(name)
-	if err != nil && err != docker.ErrNoSuchImage {
+	if err != nil && !errors.Is(err, docker.ErrNoSuchImage) {
 		return err
 	}
 
 	if image == nil {
+		// Loading streams to docker directly, bypassing the client's
+		// transport, so check docker is available before downloading
+		if err := md.checkDocker(); err != nil {
+			return err
+		}
 		// Docker Import lets the image get renamed, but it strips metadata
 		// (which includes any CMD that had been set). Docker Load doesn't let
 		// the image get renamed and doesn't return the image id or name after
@@ -79,17 +115,31 @@ func (md *MDocker) LoadImage(h *http.Request, request *rpc.ImageRequest, respons
 		// image-service assigned id and metadata with CMD are both necessary,
 		// the only way forward is to update the repositories file inside and
 		// then load it.
-		hostport, err := netutil.HostWithPort(md.imageService)
+		hostport, err := netutil.HostWithPort(md.getImageService())
 		if err != nil {
 			return err
 		}
 		source := fmt.Sprintf("http://%s/images/%s/download", hostport, request.ID)
-		resp, err := http.Get(source)
+		ctx := detachedContext(h.Context())
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return err
+		}
+		if id := requestID(ctx); id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		downloadStart := time.Now()
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 		if err != nil {
 			return err
 		}
 		defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
 
+		body := &countingReader{reader: resp.Body}
+		defer func() {
+			imageDownloadBytes.Add(float64(body.count))
+		}()
+
 		if resp.StatusCode != http.StatusOK {
 			return ErrorHTTPCode{
 				Expected: http.StatusOK,
@@ -100,7 +150,7 @@ func (md *MDocker) LoadImage(h *http.Request, request *rpc.ImageRequest, respons
 
 		// Use a response buffer so the first few bytes can be peeked at for
 		// file type detection. Uncompress the image if it is gzipped
-		responseBuffer := bufio.NewReader(resp.Body)
+		responseBuffer := bufio.NewReader(body)
 		var imageReader io.Reader = responseBuffer
 		filetypeBytes, err := responseBuffer.Peek(512)
 		if err != nil {
@@ -117,14 +167,20 @@ func (md *MDocker) LoadImage(h *http.Request, request *rpc.ImageRequest, respons
 
 		pipeReader, pipeWriter := io.Pipe()
 
-		go fixRepositoriesFile(name, imageReader, pipeWriter)
+		labels := managedLabels(kindImage, "", request.ID)
+		go fixRepositoriesFile(ctx, name, labels, imageReader, pipeWriter)
 
 		opts := docker.LoadImageOptions{
 			InputStream: pipeReader,
+			Context:     ctx,
 		}
-		if err := md.client.LoadImage(opts); err != nil {
+		loadStart := time.Now()
+		err = md.client.LoadImage(opts)
+		observeDockerStream(ctx, http.MethodPost, "/images/load", loadStart)
+		if err != nil {
 			return err
 		}
+		imageDownloadDuration.Observe(time.Since(downloadStart).Seconds())
 
 		image, err = md.client.InspectImage(name)
 		if err != nil {
@@ -143,20 +199,29 @@ func (md *MDocker) LoadImage(h *http.Request, request *rpc.ImageRequest, respons
 }
 
 // fixRepositoriesFile changes the repo name to the mistify-image-service's
-// assigned image id and tag to "latest" before it is loaded into docker
-func fixRepositoriesFile(newName string, in io.Reader, out io.WriteCloser) {
+// assigned image id and tag to "latest" before it is loaded into docker. It
+// also adds labels to the image config, since docker can't label an image
+// after it is loaded.
+func fixRepositoriesFile(ctx context.Context, newName string, labels map[string]string, in io.Reader, out io.WriteCloser) {
 	defer logx.LogReturnedErr(out.Close, nil, "failed to close output stream")
 	tarReader := tar.NewReader(in)
 	tarWriter := tar.NewWriter(out)
 	defer logx.LogReturnedErr(tarWriter.Close, nil, "failed to close tarwriter")
 
+	labeled := 0
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
 			if err == io.EOF {
+				if labeled == 0 {
+					logger(ctx).WithFields(log.Fields{
+						"error": errors.New("no image config found"),
+						"image": newName,
+					}).Error("image not labeled; it will only be recognized by its repository name")
+				}
 				return
 			}
-			log.WithField("error", err).Error("failed to get next tar header")
+			logger(ctx).WithField("error", err).Error("failed to get next tar header")
 			return
 		}
 
@@ -169,12 +234,12 @@ func fixRepositoriesFile(newName string, in io.Reader, out io.WriteCloser) {
 				repoMap := map[string]map[string]string{}
 				jsonDecoder := json.NewDecoder(tarReader)
 				if err := jsonDecoder.Decode(&repoMap); err != nil {
-					log.WithField("error", err).Error("failed to parse repositories json")
+					logger(ctx).WithField("error", err).Error("failed to parse repositories json")
 					return
 				}
 				// Should only be one key. Replace it with the new repo name
 				if len(repoMap) != 1 {
-					log.WithFields(log.Fields{
+					logger(ctx).WithFields(log.Fields{
 						"error":   errors.New("incorrect number of repos"),
 						"repoMap": repoMap,
 					}).Error("must be only one repo specified")
@@ -186,7 +251,7 @@ func fixRepositoriesFile(newName string, in io.Reader, out io.WriteCloser) {
 
 					// Should only be one tag. Replace it with the new repo name
 					if len(tagMap) != 1 {
-						log.WithFields(log.Fields{
+						logger(ctx).WithFields(log.Fields{
 							"error":   errors.New("incorrect number of tags"),
 							"repoMap": repoMap,
 						}).Error("must be only one tag specified")
@@ -206,7 +271,7 @@ func fixRepositoriesFile(newName string, in io.Reader, out io.WriteCloser) {
 				// Update the header
 				outBytes, err := json.Marshal(repoMap)
 				if err != nil {
-					log.WithField("error", err).Error("failed to marshal repositories json")
+					logger(ctx).WithField("error", err).Error("failed to marshal repositories json")
 					return
 				}
 				header.Size = int64(len(outBytes))
@@ -214,24 +279,48 @@ func fixRepositoriesFile(newName string, in io.Reader, out io.WriteCloser) {
 
 				// Write the new header and data
 				if err := tarWriter.WriteHeader(header); err != nil {
-					log.WithField("error", err).Error("failed to write repositories header")
+					logger(ctx).WithField("error", err).Error("failed to write repositories header")
 					return
 				}
 				if _, err := tarWriter.Write(outBytes); err != nil {
-					log.WithField("error", err).Error("failed to write repositories json")
+					logger(ctx).WithField("error", err).Error("failed to write repositories json")
+					return
+				}
+				continue
+			}
+			if imageConfigPattern.MatchString(header.Name) {
+				data, err := ioutil.ReadAll(tarReader)
+				if err != nil {
+					logger(ctx).WithField("error", err).Error("failed to read image config")
+					return
+				}
+				data, err = labelImageConfig(data, labels)
+				if err != nil {
+					logger(ctx).WithField("error", err).Error("failed to label image config")
+					return
+				}
+				header.Size = int64(len(data))
+
+				if err := tarWriter.WriteHeader(header); err != nil {
+					logger(ctx).WithField("error", err).Error("failed to write image config header")
+					return
+				}
+				if _, err := tarWriter.Write(data); err != nil {
+					logger(ctx).WithField("error", err).Error("failed to write image config")
 					return
 				}
+				labeled++
 				continue
 			}
 			fallthrough
 		default:
 			// Direct copy
 			if err := tarWriter.WriteHeader(header); err != nil {
-				log.WithField("error", err).Error("failed to write tar header")
+				logger(ctx).WithField("error", err).Error("failed to write tar header")
 				return
 			}
 			if _, err := io.Copy(tarWriter, tarReader); err != nil {
-				log.WithField("error", err).Error("failed to copy tar body")
+				logger(ctx).WithField("error", err).Error("failed to copy tar body")
 				return
 			}
 		}
@@ -245,7 +334,7 @@ func (md *MDocker) DeleteImage(h *http.Request, request *rpc.ImageRequest, respo
 		return err
 	}
 
-	opts := docker.RemoveImageOptions{}
+	opts := docker.RemoveImageOptions{Context: detachedContext(h.Context())}
 	if err := md.client.RemoveImageExtended(request.ID, opts); err != nil {
 		return err
 	}
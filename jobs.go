@@ -0,0 +1,239 @@
+package mdocker
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+)
+
+// Job states
+const (
+	JobStateRunning   = "running"
+	JobStateCompleted = "completed"
+	JobStateFailed    = "failed"
+	JobStateCancelled = "cancelled"
+)
+
+const (
+	// jobRetention is how long finished jobs are kept for status requests
+	jobRetention = 24 * time.Hour
+	// jobStopTimeout is how long Close waits for cancelled jobs to clean up
+	jobStopTimeout = 10 * time.Second
+)
+
+type (
+	// Job is a long running operation that continues in the background after
+	// the RPC that started it returns
+	Job struct {
+		ID       string      `json:"id"`
+		Type     string      `json:"type"`
+		Guest    string      `json:"guest"`
+		State    string      `json:"state"`
+		Error    string      `json:"error,omitempty"`
+		Started  time.Time   `json:"started"`
+		Finished *time.Time  `json:"finished,omitempty"`
+		Result   interface{} `json:"result,omitempty"`
+	}
+
+	// JobRequest is a request for a job by id
+	JobRequest struct {
+		ID string `json:"id"`
+	}
+
+	// JobResponse is the jobs affected by or listed in a request
+	JobResponse struct {
+		Jobs []*Job `json:"jobs"`
+	}
+
+	// jobManager runs and tracks background jobs
+	jobManager struct {
+		mutex   sync.Mutex
+		jobs    map[string]*Job
+		cancels map[string]context.CancelFunc
+		// running counts job goroutines, which outlive their cancellation
+		// until they have cleaned up
+		running sync.WaitGroup
+	}
+)
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// start runs a function as a background job, returning a copy of the job.
+// The function should stop when its context is cancelled. The job keeps the
+// request ID of the parent context, but outlives it.
+func (m *jobManager) start(parent context.Context, jobType, guestID string, run func(ctx context.Context) (interface{}, error)) *Job {
+	ctx, cancel := context.WithCancel(detachedContext(parent))
+	job := &Job{
+		ID:      uuid.New(),
+		Type:    jobType,
+		Guest:   guestID,
+		State:   JobStateRunning,
+		Started: time.Now(),
+	}
+
+	m.mutex.Lock()
+	m.prune()
+	m.jobs[job.ID] = job
+	m.cancels[job.ID] = cancel
+	jobCopy := *job
+	m.running.Add(1)
+	m.mutex.Unlock()
+
+	go func() {
+		defer m.running.Done()
+		result, err := run(ctx)
+		m.finish(ctx, job.ID, result, err)
+	}()
+	return &jobCopy
+}
+
+// finish records the outcome of a job
+func (m *jobManager) finish(ctx context.Context, id string, result interface{}, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job := m.jobs[id]
+	now := time.Now()
+	job.Finished = &now
+	job.Result = result
+	switch {
+	case ctx.Err() == context.Canceled:
+		job.State = JobStateCancelled
+	case err != nil:
+		job.State = JobStateFailed
+		job.Error = err.Error()
+	default:
+		job.State = JobStateCompleted
+	}
+	m.cancels[id]()
+	delete(m.cancels, id)
+
+	logger(ctx).WithFields(log.Fields{
+		"job":   job.ID,
+		"type":  job.Type,
+		"guest": job.Guest,
+		"state": job.State,
+		"error": err,
+	}).Info("job finished")
+}
+
+// prune removes old finished jobs. The mutex must be held.
+func (m *jobManager) prune() {
+	for id, job := range m.jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// get returns a copy of a job
+func (m *jobManager) get(id string) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrorNotFound{Kind: "job", ID: id}
+	}
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// list returns copies of all jobs, oldest first
+func (m *jobManager) list() []*Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobCopy := *job
+		jobs = append(jobs, &jobCopy)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+	return jobs
+}
+
+// cancel stops a running job. Cancelling a finished job does nothing.
+func (m *jobManager) cancel(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.jobs[id]; !ok {
+		return ErrorNotFound{Kind: "job", ID: id}
+	}
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+	}
+	return nil
+}
+
+// cancelAll stops all running jobs and waits for them to return, or for the
+// context to be done
+func (m *jobManager) cancelAll(ctx context.Context) error {
+	m.mutex.Lock()
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.mutex.Unlock()
+	return m.wait(ctx)
+}
+
+// wait blocks until no jobs are running or the context is done
+func (m *jobManager) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetJob returns the status of a background job
+func (md *MDocker) GetJob(h *http.Request, request *JobRequest, response *JobResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	job, err := md.jobs.get(request.ID)
+	if err != nil {
+		return err
+	}
+	response.Jobs = []*Job{job}
+	return nil
+}
+
+// ListJobs lists running and recently finished background jobs
+func (md *MDocker) ListJobs(h *http.Request, request *JobRequest, response *JobResponse) error {
+	response.Jobs = md.jobs.list()
+	return nil
+}
+
+// CancelJob cancels a running background job. The job's state changes to
+// cancelled once it has stopped.
+func (md *MDocker) CancelJob(h *http.Request, request *JobRequest, response *JobResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if err := md.jobs.cancel(request.ID); err != nil {
+		return err
+	}
+	job, err := md.jobs.get(request.ID)
+	if err != nil {
+		return err
+	}
+	response.Jobs = []*Job{job}
+	return nil
+}
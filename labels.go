@@ -0,0 +1,147 @@
+package mdocker
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pborman/uuid"
+)
+
+// Labels marking the containers and images the agent manages
+const (
+	// ManagedByLabel is set to ManagedByValue on everything the agent
+	// creates. Listing methods only return labeled containers and images,
+	// and unlabeled ones named with a uuid from before labels were added,
+	// unless asked to include unmanaged ones.
+	ManagedByLabel = "io.mistify.managed-by"
+	ManagedByValue = "mistify-agent-docker"
+	// KindLabel distinguishes guest containers, images from the image
+	// service or saved from containers, and images made for snapshots and
+	// clones, since images committed from a container inherit its labels
+	KindLabel = "io.mistify.kind"
+	// GuestLabel is the guest id of a container or the container an image
+	// was saved from
+	GuestLabel = "io.mistify.guest"
+	// ImageLabel is the image service id of an image or a container's image
+	ImageLabel = "io.mistify.image"
+	// CreatedAtLabel is when the agent created the container or image, in
+	// RFC 3339 format
+	CreatedAtLabel = "io.mistify.created-at"
+)
+
+// Values of KindLabel
+const (
+	kindGuest    = "guest"
+	kindImage    = "image"
+	kindSnapshot = "snapshot"
+	kindClone    = "clone"
+)
+
+type (
+	// listOptions are the options shared by the listing methods
+	listOptions struct {
+		// IncludeUnmanaged lists containers and images the agent didn't
+		// create as well
+		IncludeUnmanaged bool `json:"includeUnmanaged"`
+	}
+)
+
+// managedLabels returns the labels for a new container or image. Empty ids
+// are left out.
+func managedLabels(kind, guestID, imageID string) map[string]string {
+	labels := map[string]string{
+		ManagedByLabel: ManagedByValue,
+		KindLabel:      kind,
+		CreatedAtLabel: time.Now().UTC().Format(time.RFC3339),
+	}
+	if guestID != "" {
+		labels[GuestLabel] = guestID
+	}
+	if imageID != "" {
+		labels[ImageLabel] = imageID
+	}
+	return labels
+}
+
+// mergeLabels copies labels into a possibly nil label map
+func mergeLabels(dest map[string]string, labels map[string]string) map[string]string {
+	if dest == nil {
+		dest = make(map[string]string, len(labels))
+	}
+	for key, value := range labels {
+		dest[key] = value
+	}
+	return dest
+}
+
+// legacyName returns whether a container or image repository name is a uuid,
+// which is how the agent named guests and image service images before it
+// labeled them. Docker can't add labels to existing containers and images, so
+// the name is the only way to recognize them.
+func legacyName(name string) bool {
+	return uuid.Parse(name) != nil
+}
+
+// isManagedContainer returns whether a listed container is a guest created by
+// the agent. Containers also inherit the labels of their image, so only the
+// guest kind marks one the agent created.
+func isManagedContainer(ac docker.APIContainers) bool {
+	if ac.Labels[ManagedByLabel] == ManagedByValue && ac.Labels[KindLabel] == kindGuest {
+		return true
+	}
+	for _, name := range ac.Names {
+		if legacyName(strings.TrimPrefix(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isManagedImage returns whether a listed image was loaded from the image
+// service or saved from a container by the agent
+func isManagedImage(ai docker.APIImages) bool {
+	if ai.Labels[ManagedByLabel] == ManagedByValue && ai.Labels[KindLabel] == kindImage {
+		return true
+	}
+	for _, repoTag := range ai.RepoTags {
+		if repo, _ := docker.ParseRepositoryTag(repoTag); legacyName(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelImageConfig adds labels to the container config in a saved image's
+// JSON config, leaving all other fields as they were
+func labelImageConfig(data []byte, labels map[string]string) ([]byte, error) {
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, err
+	}
+	var config map[string]json.RawMessage
+	if raw, ok := image["config"]; ok {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, err
+		}
+	}
+	if config == nil {
+		config = make(map[string]json.RawMessage)
+	}
+	var existing map[string]string
+	if raw, ok := config["Labels"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if config["Labels"], err = json.Marshal(mergeLabels(existing, labels)); err != nil {
+		return nil, err
+	}
+	if image["config"], err = json.Marshal(config); err != nil {
+		return nil, err
+	}
+	return json.Marshal(image)
+}
@@ -0,0 +1,78 @@
+package mdocker_test
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestManagedLabels() {
+	guest := s.createContainer()
+	container, err := s.Docker.InspectContainer(guest.ID)
+	s.Require().NoError(err)
+	labels := container.Config.Labels
+	s.Equal(mdocker.ManagedByValue, labels[mdocker.ManagedByLabel], "should be marked as managed")
+	s.Equal(guest.ID, labels[mdocker.GuestLabel], "should have the guest id")
+	s.Equal(s.ImageID, labels[mdocker.ImageLabel], "should have the image id")
+	s.NotEmpty(labels[mdocker.CreatedAtLabel], "should have the creation time")
+
+	image, err := s.Docker.InspectImage(s.ImageID)
+	if s.NoError(err) {
+		s.Equal(mdocker.ManagedByValue, image.Config.Labels[mdocker.ManagedByLabel], "loaded image should be marked as managed")
+		s.Equal(s.ImageID, image.Config.Labels[mdocker.ImageLabel], "loaded image should have the image id")
+	}
+
+	// A container the agent didn't create, which inherits the image's labels
+	unmanagedName := "unmanaged-" + uuid.New()
+	unmanaged, err := s.Docker.CreateContainer(docker.CreateContainerOptions{
+		Name: unmanagedName,
+		Config: &docker.Config{
+			Image: s.ImageID,
+		},
+	})
+	s.Require().NoError(err)
+	s.ContainerIDs = append(s.ContainerIDs, unmanaged.ID)
+
+	// A guest from before containers were labeled, named with its uuid
+	legacyID := uuid.New()
+	legacy, err := s.Docker.CreateContainer(docker.CreateContainerOptions{
+		Name: legacyID,
+		Config: &docker.Config{
+			Image: s.ImageID,
+		},
+	})
+	s.Require().NoError(err)
+	s.ContainerIDs = append(s.ContainerIDs, legacy.ID)
+
+	listed := func(opts map[string]interface{}) map[string]bool {
+		request := &rpc.ContainerRequest{Opts: opts}
+		response := &rpc.ContainerResponse{}
+		s.Require().NoError(s.Client.Do("MDocker.ListContainers", request, response))
+		found := make(map[string]bool)
+		for _, c := range response.Containers {
+			found[c.ID] = true
+		}
+		return found
+	}
+
+	found := listed(map[string]interface{}{"All": true})
+	s.True(found[container.ID], "should list managed containers")
+	s.True(found[legacy.ID], "should list legacy containers")
+	s.False(found[unmanaged.ID], "should not list unmanaged containers by default")
+
+	found = listed(map[string]interface{}{"All": true, "includeUnmanaged": true})
+	s.True(found[container.ID], "should list managed containers")
+	s.True(found[legacy.ID], "should list legacy containers")
+	s.True(found[unmanaged.ID], "should list unmanaged containers when asked")
+
+	guests := &mdocker.GuestsResponse{}
+	s.Require().NoError(s.Client.Do("MDocker.ListGuests", &struct{}{}, guests))
+	var foundLegacy, foundUnmanaged bool
+	for _, g := range guests.Guests {
+		foundLegacy = foundLegacy || g.ID == legacyID
+		foundUnmanaged = foundUnmanaged || g.ID == unmanagedName
+	}
+	s.True(foundLegacy, "should list legacy guests")
+	s.False(foundUnmanaged, "should not list unmanaged guests")
+}
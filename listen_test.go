@@ -0,0 +1,108 @@
+package mdocker_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type ListenTestSuite struct {
+	APITestSuite
+	Dir string
+}
+
+func TestListenTestSuite(t *testing.T) {
+	suite.Run(t, new(ListenTestSuite))
+}
+
+func (s *ListenTestSuite) SetupSuite() {
+	s.APITestSuite.SetupSuite()
+
+	var err error
+	s.Dir, err = ioutil.TempDir("", "mdocker-listen")
+	s.Require().NoError(err)
+}
+
+func (s *ListenTestSuite) TearDownSuite() {
+	s.APITestSuite.TearDownSuite()
+	_ = os.RemoveAll(s.Dir)
+}
+
+func (s *ListenTestSuite) stop(server *graceful.Server) {
+	stopChan := server.StopChan()
+	server.Stop(5 * time.Second)
+	<-stopChan
+}
+
+func (s *ListenTestSuite) TestUnixSocket() {
+	socket := filepath.Join(s.Dir, "mdocker.sock")
+	// A stale socket should be replaced
+	stale, err := net.Listen("unix", socket)
+	s.Require().NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	s.Require().NoError(stale.Close())
+
+	server, err := s.MDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		UnixSocket: socket,
+		SocketMode: 0600,
+	})
+	s.Require().NoError(err)
+	defer s.stop(server)
+	time.Sleep(200 * time.Millisecond)
+
+	info, err := os.Stat(socket)
+	s.Require().NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://mdocker" + mdocker.HealthPath)
+	if s.NoError(err) {
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		s.Equal(http.StatusOK, resp.StatusCode)
+	}
+}
+
+func (s *ListenTestSuite) TestNotSocket() {
+	path := filepath.Join(s.Dir, "regular")
+	s.Require().NoError(ioutil.WriteFile(path, []byte("foo"), 0600))
+
+	_, err := s.MDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		UnixSocket: path,
+	})
+	s.Error(err, "should not replace a regular file")
+}
+
+func (s *ListenTestSuite) TestListener() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+
+	server, err := s.MDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		Listener: listener,
+	})
+	s.Require().NoError(err)
+	defer s.stop(server)
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", listener.Addr(), mdocker.HealthPath))
+	if s.NoError(err) {
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		s.Equal(http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,283 @@
+package mdocker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/mux"
+)
+
+// LogsPath is the path of the streaming logs endpoint. The {id} segment is
+// the container id or name.
+const LogsPath = "/containers/{id}/logs"
+
+// logsDefaultMaxOutput is the per-stream limit used when a logs request
+// doesn't specify its own
+const logsDefaultMaxOutput = 1024 * 1024
+
+type (
+	// LogsRequest is a request for a container's stdout/stderr logs
+	LogsRequest struct {
+		ID string `json:"id"`
+		// Stdout and Stderr select the streams to return. If neither is set,
+		// both are returned.
+		Stdout bool `json:"stdout,omitempty"`
+		Stderr bool `json:"stderr,omitempty"`
+		// Timestamps prefixes each line with its RFC3339Nano timestamp
+		Timestamps bool `json:"timestamps,omitempty"`
+		// Tail limits output to the last N lines. Zero means all lines.
+		Tail uint `json:"tail,omitempty"`
+		// Since and Until limit output to lines logged in that time range
+		Since time.Time `json:"since,omitempty"`
+		Until time.Time `json:"until,omitempty"`
+		// MaxOutput is the maximum number of bytes returned per stream
+		MaxOutput uint `json:"maxOutput,omitempty"`
+	}
+
+	// LogsResponse contains a container's logs
+	LogsResponse struct {
+		Stdout    string `json:"stdout"`
+		Stderr    string `json:"stderr"`
+		Truncated bool   `json:"truncated"`
+	}
+
+	// untilWriter drops timestamped log lines written after a cutoff time and
+	// optionally strips the timestamps from the lines it keeps
+	untilWriter struct {
+		out            io.Writer
+		until          time.Time
+		keepTimestamps bool
+		partial        []byte
+	}
+
+	// flushWriter flushes an http response after every write so streamed
+	// output reaches the client immediately
+	flushWriter struct {
+		mutex   sync.Mutex
+		w       io.Writer
+		flusher http.Flusher
+	}
+)
+
+// Write buffers p and passes through every complete line that is not past the
+// cutoff
+func (w *untilWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.partial[:i+1]
+		w.partial = w.partial[i+1:]
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// flush passes through a final line that had no trailing newline. It should
+// be called once the stream has ended.
+func (w *untilWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	line := w.partial
+	w.partial = nil
+	return w.writeLine(line)
+}
+
+// writeLine passes through a timestamped line if it is not past the cutoff
+func (w *untilWriter) writeLine(line []byte) error {
+	space := bytes.IndexByte(line, ' ')
+	if space < 0 {
+		return nil
+	}
+	ts, err := time.Parse(time.RFC3339Nano, string(line[:space]))
+	if err != nil || ts.After(w.until) {
+		return nil
+	}
+	if !w.keepTimestamps {
+		line = line[space+1:]
+	}
+	_, err = w.out.Write(line)
+	return err
+}
+
+// Write writes p and flushes it to the client
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.w.Write(p)
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+// logsOptions translates a logs request into docker options, wrapping the
+// provided output writers as needed. The returned flush func must be called
+// once the logs have been read, to write out any buffered final lines.
+func logsOptions(request *LogsRequest, stdout, stderr io.Writer) (docker.LogsOptions, func() error) {
+	opts := docker.LogsOptions{
+		Container:  request.ID,
+		Stdout:     request.Stdout,
+		Stderr:     request.Stderr,
+		Timestamps: request.Timestamps,
+	}
+	if !opts.Stdout && !opts.Stderr {
+		opts.Stdout = true
+		opts.Stderr = true
+	}
+	if request.Tail > 0 {
+		opts.Tail = strconv.FormatUint(uint64(request.Tail), 10)
+	}
+	if !request.Since.IsZero() {
+		opts.Since = request.Since.Unix()
+	}
+	// The docker API has no upper bound on log time, so timestamps are
+	// requested and used to filter lines here instead
+	flush := func() error { return nil }
+	if !request.Until.IsZero() {
+		opts.Timestamps = true
+		stdoutUntil := &untilWriter{out: stdout, until: request.Until, keepTimestamps: request.Timestamps}
+		stderrUntil := &untilWriter{out: stderr, until: request.Until, keepTimestamps: request.Timestamps}
+		stdout, stderr = stdoutUntil, stderrUntil
+		flush = func() error {
+			if err := stdoutUntil.flush(); err != nil {
+				return err
+			}
+			return stderrUntil.flush()
+		}
+	}
+	opts.OutputStream = stdout
+	opts.ErrorStream = stderr
+	return opts, flush
+}
+
+// GetContainerLogs retrieves the stdout/stderr logs of a Docker container
+func (md *MDocker) GetContainerLogs(h *http.Request, request *LogsRequest, response *LogsResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+
+	maxOutput := logsDefaultMaxOutput
+	if request.MaxOutput > 0 {
+		maxOutput = int(request.MaxOutput)
+	}
+	stdout := newLimitedBuffer(maxOutput)
+	stderr := newLimitedBuffer(maxOutput)
+
+	if err := md.checkDocker(); err != nil {
+		return err
+	}
+	opts, flush := logsOptions(request, stdout, stderr)
+	start := time.Now()
+	err := md.client.Logs(opts)
+	observeDockerStream(h.Context(), http.MethodGet, "/containers/{id}/logs", start)
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	response.Stdout = stdout.String()
+	response.Stderr = stderr.String()
+	response.Truncated = stdout.Truncated() || stderr.Truncated()
+	return nil
+}
+
+// logsRequestFromQuery builds a logs request from the streaming endpoint's
+// query parameters
+func logsRequestFromQuery(r *http.Request) (*LogsRequest, bool, error) {
+	query := r.URL.Query()
+	request := &LogsRequest{
+		ID:         mux.Vars(r)["id"],
+		Stdout:     query.Get("stdout") == "true",
+		Stderr:     query.Get("stderr") == "true",
+		Timestamps: query.Get("timestamps") == "true",
+	}
+	follow := query.Get("follow") == "true"
+
+	if tail := query.Get("tail"); tail != "" {
+		n, err := strconv.ParseUint(tail, 10, 32)
+		if err != nil {
+			return nil, false, errors.New("invalid tail")
+		}
+		request.Tail = uint(n)
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{
+		{"since", &request.Since},
+		{"until", &request.Until},
+	} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, false, errors.New("invalid " + param.name)
+		}
+		*param.dest = t
+	}
+
+	return request, follow, nil
+}
+
+// logsHandler streams a container's logs as plain text. With follow=true the
+// response stays open and new output is sent as it is logged, until the
+// client disconnects or the container stops.
+func (md *MDocker) logsHandler(w http.ResponseWriter, r *http.Request) {
+	request, follow, err := logsRequestFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := md.client.InspectContainer(request.ID); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := md.checkDocker(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	output := &flushWriter{w: w, flusher: flusher}
+	opts, flush := logsOptions(request, output, output)
+	opts.Follow = follow
+	opts.Context = r.Context()
+
+	start := time.Now()
+	err = md.client.Logs(opts)
+	observeDockerStream(r.Context(), http.MethodGet, "/containers/{id}/logs", start)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil && r.Context().Err() == nil {
+		// Headers have already been sent, so all that can be done is log it
+		logger(r.Context()).WithFields(log.Fields{
+			"error":       err,
+			"containerID": request.ID,
+		}).Error("failed to stream container logs")
+	}
+}
@@ -0,0 +1,116 @@
+package mdocker_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent-docker"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+)
+
+// logsContainer runs a container that logs four lines to stdout, the last
+// without a trailing newline, with a pause after the second, and waits for it
+// to exit
+func (s *ContainerTestSuite) logsContainer() string {
+	container, err := s.Docker.CreateContainer(docker.CreateContainerOptions{
+		Name: "logs-" + uuid.New(),
+		Config: &docker.Config{
+			Image: s.ImageID,
+			Cmd:   []string{"sh", "-c", "echo one; echo two; sleep 2; echo three; printf four"},
+		},
+	})
+	s.Require().NoError(err)
+	s.ContainerIDs = append(s.ContainerIDs, container.ID)
+	s.Require().NoError(s.Docker.StartContainer(container.ID, nil))
+	_, err = s.Docker.WaitContainer(container.ID)
+	s.Require().NoError(err)
+	return container.ID
+}
+
+func (s *ContainerTestSuite) TestGetContainerLogs() {
+	id := s.logsContainer()
+
+	// Find when the lines were logged to pick the time ranges
+	response := &mdocker.LogsResponse{}
+	s.Require().NoError(s.Client.Do("MDocker.GetContainerLogs", &mdocker.LogsRequest{ID: id, Timestamps: true}, response))
+	times := make(map[string]time.Time)
+	for _, line := range strings.Split(response.Stdout, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		s.Require().Len(fields, 2, "should be timestamped: %q", line)
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		s.Require().NoError(err)
+		times[fields[1]] = ts
+	}
+	s.Require().Len(times, 4, "should log every line")
+
+	tests := []struct {
+		description string
+		request     *mdocker.LogsRequest
+		expectedErr bool
+		stdout      string
+	}{
+		{"missing id",
+			&mdocker.LogsRequest{}, true, ""},
+		{"invalid id",
+			&mdocker.LogsRequest{ID: "asdf"}, true, ""},
+		{"valid id",
+			&mdocker.LogsRequest{ID: id}, false, "one\ntwo\nthree\nfour"},
+		{"stderr only",
+			&mdocker.LogsRequest{ID: id, Stderr: true}, false, ""},
+		{"tail",
+			&mdocker.LogsRequest{ID: id, Tail: 2}, false, "three\nfour"},
+		{"since",
+			&mdocker.LogsRequest{ID: id, Since: times["three"].Truncate(time.Second)}, false, "three\nfour"},
+		{"until",
+			&mdocker.LogsRequest{ID: id, Until: times["two"].Add(500 * time.Millisecond)}, false, "one\ntwo\n"},
+		{"until after the last line",
+			&mdocker.LogsRequest{ID: id, Until: time.Now().Add(time.Hour)}, false, "one\ntwo\nthree\nfour"},
+		{"time range",
+			&mdocker.LogsRequest{ID: id, Since: times["three"].Truncate(time.Second), Until: times["three"]}, false, "three\n"},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &mdocker.LogsResponse{}
+		err := s.Client.Do("MDocker.GetContainerLogs", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) {
+			s.Equal(test.stdout, response.Stdout, msg("unexpected output"))
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestLogsEndpoint() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	tests := []struct {
+		description string
+		id          string
+		query       string
+		status      int
+	}{
+		{"invalid id", "asdf", "", http.StatusNotFound},
+		{"invalid tail", guest.ID, "tail=foo", http.StatusBadRequest},
+		{"invalid since", guest.ID, "since=foo", http.StatusBadRequest},
+		{"valid request", guest.ID, "tail=10&timestamps=true", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		u := fmt.Sprintf("http://127.0.0.1:%d%s?%s", s.Port, strings.Replace(mdocker.LogsPath, "{id}", test.id, 1), test.query)
+		resp, err := http.Get(u)
+		if !s.NoError(err, msg("request should succeed")) {
+			continue
+		}
+		s.Equal(test.status, resp.StatusCode, msg("should return expected status"))
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
@@ -17,17 +18,54 @@ type (
 
 	// MDocker is the Mistify Docker subagent service
 	MDocker struct {
-		endpoint     string
-		imageService string
-		client       *docker.Client
+		endpoint   string
+		client     *docker.Client
+		network    networkBackend
+		health     *healthChecker
+		supervisor *dockerSupervisor
+		operations operationTracker
+		audit      *auditLog
+		jobs       *jobManager
+		// portsMutex serializes checking for and publishing host ports
+		portsMutex sync.Mutex
+
+		// settingsMutex guards the settings that can be changed at runtime
+		settingsMutex sync.RWMutex
+		imageService  string
+		resources     ResourceLimits
+		security      SecurityPolicy
+		devices       []DeviceConfig
+		exportDir     string
 	}
 )
 
 // New creates a new MDocker with a docker client
 func New(endpoint, imageService, tlsCertPath string) (*MDocker, error) {
+	config := DefaultConfig()
+	config.Docker.Endpoint = endpoint
+	config.Docker.CertPath = tlsCertPath
+	config.ImageService = imageService
+	return NewWithConfig(config)
+}
+
+// NewWithConfig creates a new MDocker with a docker client from the provided
+// configuration
+func NewWithConfig(config *Config) (*MDocker, error) {
+	if err := config.Validate(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("invalid configuration")
+		return nil, err
+	}
+	endpoint := config.Docker.Endpoint
+	tlsCertPath := config.Docker.CertPath
+	network, err := newNetworkBackend(config.Network.Backend)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new Docker client
 	var client *docker.Client
-	var err error
 	if tlsCertPath == "" {
 		client, err = docker.NewClient(endpoint)
 		if err != nil {
@@ -56,6 +94,19 @@ func New(endpoint, imageService, tlsCertPath string) (*MDocker, error) {
 		}
 	}
 
+	// Record the latency of every docker call, tag it with the request ID of
+	// the RPC that made it, and fail fast when docker is known to be
+	// unavailable
+	supervisor := newDockerSupervisor(client)
+	transport := client.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client.HTTPClient.Transport = &availabilityTransport{
+		next:       &requestIDTransport{next: &instrumentedTransport{next: transport}},
+		supervisor: supervisor,
+	}
+
 	// Make sure we can actually communicate with Docker
 	if err := client.Ping(); err != nil {
 		log.WithFields(log.Fields{
@@ -65,11 +116,84 @@ func New(endpoint, imageService, tlsCertPath string) (*MDocker, error) {
 		return nil, err
 	}
 
-	return &MDocker{
+	md := &MDocker{
 		endpoint:     endpoint,
-		imageService: imageService,
 		client:       client,
-	}, nil
+		network:      network,
+		supervisor:   supervisor,
+		jobs:         newJobManager(),
+		imageService: config.ImageService,
+		resources:    config.Resources,
+		security:     config.Security,
+		devices:      config.Devices,
+		exportDir:    config.ExportDir,
+	}
+	if config.Audit.Path != "" {
+		md.audit, err = newAuditLog(config.Audit)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  config.Audit.Path,
+				"func":  "newAuditLog",
+			}).Error("failed to open audit log")
+			return nil, err
+		}
+	}
+	md.health = newHealthChecker(md.healthChecks()...)
+	go supervisor.run()
+	return md, nil
+}
+
+// Reconfigure applies the settings that can be changed at runtime, the image
+// service, resource limits, security policy, device allowlist and export
+// directory. Other settings require a new MDocker.
+func (md *MDocker) Reconfigure(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	md.settingsMutex.Lock()
+	defer md.settingsMutex.Unlock()
+	md.imageService = config.ImageService
+	md.resources = config.Resources
+	md.security = config.Security
+	md.devices = config.Devices
+	md.exportDir = config.ExportDir
+	return nil
+}
+
+// getImageService returns the current image service address
+func (md *MDocker) getImageService() string {
+	md.settingsMutex.RLock()
+	defer md.settingsMutex.RUnlock()
+	return md.imageService
+}
+
+// getResourceLimits returns the current resource defaults and limits
+func (md *MDocker) getResourceLimits() ResourceLimits {
+	md.settingsMutex.RLock()
+	defer md.settingsMutex.RUnlock()
+	return md.resources
+}
+
+// getSecurityPolicy returns the current host security policy
+func (md *MDocker) getSecurityPolicy() SecurityPolicy {
+	md.settingsMutex.RLock()
+	defer md.settingsMutex.RUnlock()
+	return md.security
+}
+
+// getExportDir returns the current export directory
+func (md *MDocker) getExportDir() string {
+	md.settingsMutex.RLock()
+	defer md.settingsMutex.RUnlock()
+	return md.exportDir
+}
+
+// getDevices returns the current device allowlist
+func (md *MDocker) getDevices() []DeviceConfig {
+	md.settingsMutex.RLock()
+	defer md.settingsMutex.RUnlock()
+	return md.devices
 }
 
 // RequestOpts extracts the request opts into an appropriate struct
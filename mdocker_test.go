@@ -1,11 +1,17 @@
 package mdocker_test
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/mistifyio/mistify-agent-docker"
 	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -75,3 +81,28 @@ func (s *MDockerTestSuite) TestGetInfo() {
 	s.NoError(s.Client.Do("MDocker.GetInfo", request, response))
 	s.NotEmpty(response.ID)
 }
+
+func (s *MDockerTestSuite) TestMetrics() {
+	s.NoError(s.Client.Do("MDocker.GetInfo", &struct{}{}, &docker.DockerInfo{}))
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, mdocker.MetricsPath))
+	if !s.NoError(err) {
+		return
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	s.NoError(err)
+	s.Contains(string(body), `mdocker_rpc_calls_total{method="MDocker.GetInfo"}`)
+	s.Contains(string(body), "mdocker_docker_request_duration_seconds")
+	s.Contains(string(body), `mdocker_containers{state="running"}`)
+}
+
+func (s *MDockerTestSuite) TestWaitIdle() {
+	s.NoError(s.Client.Do("MDocker.GetInfo", &struct{}{}, &docker.DockerInfo{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.NoError(s.MDocker.WaitIdle(ctx), "should be idle once calls have returned")
+}
@@ -0,0 +1,247 @@
+package mdocker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	gorillarpc "github.com/gorilla/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is the path of the Prometheus metrics endpoint
+const MetricsPath = "/metrics"
+
+const metricsNamespace = "mdocker"
+
+type (
+	// instrumentedTransport records the latency of every docker API call
+	instrumentedTransport struct {
+		next http.RoundTripper
+	}
+
+	// countingReader counts bytes as they are read through it
+	countingReader struct {
+		reader io.Reader
+		count  int64
+	}
+
+	// containerStateCollector reports the number of containers in each state
+	// at scrape time
+	containerStateCollector struct {
+		md   *MDocker
+		desc *prometheus.Desc
+	}
+
+	// rpcStartKey is the context key for the time an RPC call started
+	rpcStartKey struct{}
+)
+
+var (
+	rpcCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_calls_total",
+			Help:      "Number of RPC calls, by method.",
+		},
+		[]string{"method"},
+	)
+	rpcErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_errors_total",
+			Help:      "Number of RPC calls that returned an error, by method.",
+		},
+		[]string{"method"},
+	)
+	rpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "RPC call latency, by method.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"method"},
+	)
+	dockerDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "docker_request_duration_seconds",
+			Help:      "Docker API request latency, by HTTP method and path.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"method", "path"},
+	)
+	imageDownloadBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_download_bytes_total",
+			Help:      "Bytes downloaded from the image service.",
+		},
+	)
+	imageDownloadDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_download_duration_seconds",
+			Help:      "Time taken to download and load an image from the image service.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+	)
+	ovsCommandFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ovs_command_failures_total",
+			Help:      "Number of failed OVS commands, by command and operation.",
+		},
+		[]string{"command", "operation"},
+	)
+)
+
+// RoundTrip times the request and passes it along
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	dockerDuration.WithLabelValues(req.Method, dockerPathLabel(req.URL.Path)).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// observeDockerStream records the latency of a streaming or hijacked docker
+// call, which dials docker directly and so bypasses instrumentedTransport.
+// The request ID can't be added to such a call's headers either, so it is
+// logged along with the call instead.
+func observeDockerStream(ctx context.Context, method, path string, start time.Time) {
+	duration := time.Since(start)
+	dockerDuration.WithLabelValues(method, path).Observe(duration.Seconds())
+	logger(ctx).WithFields(log.Fields{
+		"method":   method,
+		"path":     path,
+		"duration": duration.String(),
+	}).Debug("docker streaming call")
+}
+
+// dockerPathLabel reduces a docker API path to a low cardinality label by
+// dropping the API version and replacing resource ids, e.g.
+// /v1.20/containers/abc123/start becomes /containers/{id}/start
+func dockerPathLabel(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v1.") {
+		parts = parts[1:]
+	}
+	if len(parts) >= 3 {
+		switch parts[0] {
+		case "containers", "exec":
+			parts[1] = "{id}"
+		case "images":
+			// Image names may contain slashes
+			parts = []string{parts[0], "{name}", parts[len(parts)-1]}
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// Read reads from the underlying reader, counting the bytes
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+func newContainerStateCollector(md *MDocker) *containerStateCollector {
+	return &containerStateCollector{
+		md: md,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "containers"),
+			"Number of managed containers, by state.",
+			[]string{"state"},
+			nil,
+		),
+	}
+}
+
+// Describe sends the collector's metric descriptions
+func (c *containerStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect counts managed containers by state
+func (c *containerStateCollector) Collect(ch chan<- prometheus.Metric) {
+	containers, err := c.md.client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		log.WithField("error", err).Error("failed to list containers for metrics")
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+
+	counts := map[string]float64{
+		GuestStateCreated: 0,
+		GuestStateRunning: 0,
+		GuestStatePaused:  0,
+		GuestStateStopped: 0,
+		GuestStateError:   0,
+	}
+	for _, container := range containers {
+		if !isManagedContainer(container) {
+			continue
+		}
+		switch container.State {
+		case "created":
+			counts[GuestStateCreated]++
+		case "running", "restarting":
+			counts[GuestStateRunning]++
+		case "paused":
+			counts[GuestStatePaused]++
+		case "dead":
+			counts[GuestStateError]++
+		default:
+			counts[GuestStateStopped]++
+		}
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, count, state)
+	}
+}
+
+// metricsHandler builds the handler for the metrics endpoint
+func (md *MDocker) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcCalls,
+		rpcErrors,
+		rpcDuration,
+		dockerDuration,
+		imageDownloadBytes,
+		imageDownloadDuration,
+		ovsCommandFailures,
+		newContainerStateCollector(md),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// interceptRPC is called before each RPC method is dispatched
+func (md *MDocker) interceptRPC(i *gorillarpc.RequestInfo) *http.Request {
+	ctx := context.WithValue(i.Request.Context(), rpcStartKey{}, time.Now())
+	return i.Request.WithContext(ctx)
+}
+
+// afterRPC is called after each RPC method has returned
+func (md *MDocker) afterRPC(i *gorillarpc.RequestInfo) {
+	rpcCalls.WithLabelValues(i.Method).Inc()
+	if i.Error != nil {
+		rpcErrors.WithLabelValues(i.Method).Inc()
+	}
+	// Calls rejected by the rpc server before dispatch have no request
+	if i.Request == nil {
+		return
+	}
+	if start, ok := i.Request.Context().Value(rpcStartKey{}).(time.Time); ok {
+		rpcDuration.WithLabelValues(i.Method).Observe(time.Since(start).Seconds())
+	}
+}
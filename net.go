@@ -1,6 +1,9 @@
 package mdocker
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strconv"
@@ -10,7 +13,7 @@ import (
 	"github.com/mistifyio/mistify-agent/client"
 )
 
-func getPortForContainerInterface(guestID, ifaceName string) (string, error) {
+func getPortForContainerInterface(ctx context.Context, guestID, ifaceName string) (string, error) {
 	command := "ovs-vsctl"
 	args := []string{
 		"--data=bare",
@@ -23,11 +26,16 @@ func getPortForContainerInterface(guestID, ifaceName string) (string, error) {
 	}
 	output, err := exec.Command(command, args...).CombinedOutput()
 	if err != nil {
-		e := fmt.Errorf("failed to look up name of interface %s for guest %s",
-			ifaceName,
-			guestID,
-		)
-		log.WithFields(log.Fields{
+		ovsCommandFailures.WithLabelValues(command, "find").Inc()
+		e := ErrorNetwork{
+			Message: fmt.Sprintf("failed to look up name of interface %s for guest %s",
+				ifaceName,
+				guestID,
+			),
+			Command: command,
+			Output:  string(output),
+		}
+		logger(ctx).WithFields(log.Fields{
 			"error":   err,
 			"command": command,
 			"args":    args,
@@ -38,7 +46,7 @@ func getPortForContainerInterface(guestID, ifaceName string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-func addPort(g *client.Guest, nic client.Nic) (string, error) {
+func addPort(ctx context.Context, g *client.Guest, nic client.Nic) (string, error) {
 	command := "ovs-docker"
 	args := []string{"add-port",
 		nic.Network,
@@ -47,8 +55,13 @@ func addPort(g *client.Guest, nic client.Nic) (string, error) {
 		"--macaddress=" + nic.Mac, // ovs-docker errors if separate
 	}
 	if output, err := exec.Command(command, args...).CombinedOutput(); err != nil {
-		e := fmt.Errorf("failed to add interface %s", nic.Name)
-		log.WithFields(log.Fields{
+		ovsCommandFailures.WithLabelValues(command, "add-port").Inc()
+		e := ErrorNetwork{
+			Message: fmt.Sprintf("failed to add interface %s", nic.Name),
+			Command: command,
+			Output:  string(output),
+		}
+		logger(ctx).WithFields(log.Fields{
 			"error":   err,
 			"command": command,
 			"args":    args,
@@ -56,10 +69,10 @@ func addPort(g *client.Guest, nic client.Nic) (string, error) {
 		}).Error(e)
 		return "", e
 	}
-	return getPortForContainerInterface(g.ID, nic.Name)
+	return getPortForContainerInterface(ctx, g.ID, nic.Name)
 }
 
-func tagPort(port string, vlanInts []int) error {
+func tagPort(ctx context.Context, port string, vlanInts []int) error {
 	command := "ovs-vsctl"
 
 	if len(vlanInts) == 0 {
@@ -79,8 +92,13 @@ func tagPort(port string, vlanInts []int) error {
 	}
 
 	if output, err := exec.Command(command, args...).CombinedOutput(); err != nil {
-		e := fmt.Errorf("failed to tag interface %s", port)
-		log.WithFields(log.Fields{
+		ovsCommandFailures.WithLabelValues(command, "set").Inc()
+		e := ErrorNetwork{
+			Message: fmt.Sprintf("failed to tag interface %s", port),
+			Command: command,
+			Output:  string(output),
+		}
+		logger(ctx).WithFields(log.Fields{
 			"error":   err,
 			"command": command,
 			"args":    args,
@@ -93,13 +111,13 @@ func tagPort(port string, vlanInts []int) error {
 }
 
 // addInterfaces adds network interfaces to a guest container
-func addInterfaces(g *client.Guest) error {
+func addInterfaces(ctx context.Context, g *client.Guest) error {
 	for _, nic := range g.Nics {
-		port, err := addPort(g, nic)
+		port, err := addPort(ctx, g, nic)
 		if err != nil {
 			return err
 		}
-		if err := tagPort(port, nic.VLANs); err != nil {
+		if err := tagPort(ctx, port, nic.VLANs); err != nil {
 			return err
 		}
 	}
@@ -107,7 +125,7 @@ func addInterfaces(g *client.Guest) error {
 }
 
 // removeInterfaces removes network interfaces from a guest container
-func removeInterfaces(g *client.Guest) error {
+func removeInterfaces(ctx context.Context, g *client.Guest) error {
 	command := "ovs-docker"
 	for _, nic := range g.Nics {
 		args := []string{
@@ -119,8 +137,13 @@ func removeInterfaces(g *client.Guest) error {
 		if output, err := exec.Command(command, args...).CombinedOutput(); err != nil {
 			// Ignore errors when trying to remove interface that is already gone
 			if !strings.Contains(strings.ToLower(string(output)), "failed to find any attached port") {
-				e := fmt.Errorf("failed to remove interface %s", nic.Name)
-				log.WithFields(log.Fields{
+				ovsCommandFailures.WithLabelValues(command, "del-port").Inc()
+				e := ErrorNetwork{
+					Message: fmt.Sprintf("failed to remove interface %s", nic.Name),
+					Command: command,
+					Output:  string(output),
+				}
+				logger(ctx).WithFields(log.Fields{
 					"error":   err,
 					"command": command,
 					"args":    args,
@@ -132,3 +155,115 @@ func removeInterfaces(g *client.Guest) error {
 	}
 	return nil
 }
+
+// ovsMap decodes an OVSDB map column from ovs-vsctl's json output, which is
+// formatted as ["map", [[key, value], ...]]
+func ovsMap(raw json.RawMessage) (map[string]interface{}, error) {
+	var column []json.RawMessage
+	if err := json.Unmarshal(raw, &column); err != nil {
+		return nil, err
+	}
+	if len(column) != 2 {
+		return nil, errors.New("unexpected ovs map format")
+	}
+	var pairs [][]interface{}
+	if err := json.Unmarshal(column[1], &pairs); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(pairs))
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, errors.New("unexpected ovs map pair format")
+		}
+		key, ok := pair[0].(string)
+		if !ok {
+			return nil, errors.New("unexpected ovs map key type")
+		}
+		m[key] = pair[1]
+	}
+	return m, nil
+}
+
+// getInterfaceStatistics looks up the OVS ports created for a guest's
+// interfaces and returns their traffic counters
+func getInterfaceStatistics(ctx context.Context, guestID string) ([]*NicStats, error) {
+	command := "ovs-vsctl"
+	args := []string{
+		"--format=json",
+		"--columns=name,external_ids,statistics",
+		"find",
+		"interface",
+		"external_ids:container_id=" + guestID,
+	}
+	output, err := exec.Command(command, args...).Output()
+	if err != nil {
+		ovsCommandFailures.WithLabelValues(command, "find").Inc()
+		e := ErrorNetwork{
+			Message: fmt.Sprintf("failed to look up interface statistics for guest %s", guestID),
+			Command: command,
+			Output:  string(output),
+		}
+		logger(ctx).WithFields(log.Fields{
+			"error":   err,
+			"command": command,
+			"args":    args,
+			"output":  string(output),
+		}).Error(e)
+		return nil, e
+	}
+
+	var table struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(output, &table); err != nil {
+		return nil, err
+	}
+
+	nics := make([]*NicStats, 0, len(table.Data))
+	for _, row := range table.Data {
+		if len(row) != 3 {
+			return nil, errors.New("unexpected ovs row format")
+		}
+		nic := &NicStats{}
+		if err := json.Unmarshal(row[0], &nic.Port); err != nil {
+			return nil, err
+		}
+		externalIDs, err := ovsMap(row[1])
+		if err != nil {
+			return nil, err
+		}
+		nic.Name, _ = externalIDs["container_iface"].(string)
+		statistics, err := ovsMap(row[2])
+		if err != nil {
+			return nil, err
+		}
+		for key, dest := range map[string]*uint64{
+			"rx_bytes":   &nic.RxBytes,
+			"rx_packets": &nic.RxPackets,
+			"rx_errors":  &nic.RxErrors,
+			"rx_dropped": &nic.RxDropped,
+			"tx_bytes":   &nic.TxBytes,
+			"tx_packets": &nic.TxPackets,
+			"tx_errors":  &nic.TxErrors,
+			"tx_dropped": &nic.TxDropped,
+		} {
+			// encoding/json decodes all numbers in an interface{} as float64
+			if value, ok := statistics[key].(float64); ok {
+				*dest = uint64(value)
+			}
+		}
+		nics = append(nics, nic)
+	}
+	return nics, nil
+}
+
+// checkOVS makes sure ovs-vsctl can talk to the OVS database
+func checkOVS(ctx context.Context) error {
+	command := "ovs-vsctl"
+	args := []string{"show"}
+	if output, err := exec.CommandContext(ctx, command, args...).CombinedOutput(); err != nil {
+		ovsCommandFailures.WithLabelValues(command, "show").Inc()
+		return fmt.Errorf("ovs-vsctl show failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package mdocker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+// Network backends
+const (
+	// NetworkBackendOVS attaches guest nics to Open vSwitch bridges
+	NetworkBackendOVS = "ovs"
+	// NetworkBackendNone leaves guests without network interfaces
+	NetworkBackendNone = "none"
+)
+
+type (
+	// networkBackend manages the network interfaces of guest containers
+	networkBackend interface {
+		addInterfaces(context.Context, *client.Guest) error
+		removeInterfaces(context.Context, *client.Guest) error
+		interfaceStatistics(ctx context.Context, guestID string) ([]*NicStats, error)
+	}
+
+	ovsNetwork  struct{}
+	noneNetwork struct{}
+)
+
+func newNetworkBackend(name string) (networkBackend, error) {
+	switch name {
+	case NetworkBackendOVS, "":
+		return ovsNetwork{}, nil
+	case NetworkBackendNone:
+		return noneNetwork{}, nil
+	default:
+		return nil, fmt.Errorf("unknown network backend %q", name)
+	}
+}
+
+func (ovsNetwork) addInterfaces(ctx context.Context, g *client.Guest) error {
+	return addInterfaces(ctx, g)
+}
+
+func (ovsNetwork) removeInterfaces(ctx context.Context, g *client.Guest) error {
+	return removeInterfaces(ctx, g)
+}
+
+func (ovsNetwork) interfaceStatistics(ctx context.Context, guestID string) ([]*NicStats, error) {
+	return getInterfaceStatistics(ctx, guestID)
+}
+
+// check makes sure ovs is usable, for the readiness check
+func (ovsNetwork) check(ctx context.Context) error {
+	return checkOVS(ctx)
+}
+
+func (noneNetwork) addInterfaces(context.Context, *client.Guest) error {
+	return nil
+}
+
+func (noneNetwork) removeInterfaces(context.Context, *client.Guest) error {
+	return nil
+}
+
+func (noneNetwork) interfaceStatistics(context.Context, string) ([]*NicStats, error) {
+	return []*NicStats{}, nil
+}
@@ -0,0 +1,80 @@
+package mdocker
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// operationTracker counts in-flight RPC operations so shutdown can wait for
+// them to finish
+type operationTracker struct {
+	mutex sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
+// begin records the start of an operation
+func (t *operationTracker) begin() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+}
+
+// end records the end of an operation
+func (t *operationTracker) end() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+	}
+}
+
+// wait blocks until there are no operations in flight or the context is done
+func (t *operationTracker) wait(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.count == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackOperations wraps the server's handler, counting RPC calls as in flight
+// until their handler returns. Unlike the rpc server's after func, this also
+// covers calls whose response can't be written or whose method panics.
+func (md *MDocker) trackOperations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != rpc.RPCPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		md.operations.begin()
+		defer md.operations.end()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WaitIdle blocks until no RPC operations or background jobs are in flight,
+// returning an error if the context is done first. It is intended for use
+// during shutdown, after the HTTP server has stopped accepting requests.
+func (md *MDocker) WaitIdle(ctx context.Context) error {
+	if err := md.operations.wait(ctx); err != nil {
+		return err
+	}
+	return md.jobs.wait(ctx)
+}
@@ -0,0 +1,46 @@
+package mdocker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func (s *ContainerTestSuite) TestWaitIdleAfterDisconnect() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	// A response large enough that writing it fails once the client is gone
+	body, err := json.Marshal(map[string]interface{}{
+		"method": "MDocker.ExecContainer",
+		"params": []interface{}{&mdocker.ExecRequest{
+			ID:        guest.ID,
+			Cmd:       []string{"sh", "-c", "yes | head -c 4000000"},
+			MaxOutput: 8 * 1024 * 1024,
+		}},
+		"id": 0,
+	})
+	s.Require().NoError(err)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, rpc.RPCPath), bytes.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+
+	conn, err := net.Dial("tcp", req.URL.Host)
+	s.Require().NoError(err)
+	s.Require().NoError(req.Write(conn))
+	// Disconnect as soon as the response starts
+	_, err = conn.Read(make([]byte, 1))
+	s.NoError(err)
+	s.NoError(conn.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.NoError(s.MDocker.WaitIdle(ctx), "should be idle after the client disconnected")
+}
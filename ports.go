@@ -0,0 +1,301 @@
+package mdocker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+const (
+	// PortsMetadataKey is the guest metadata key listing the ports to
+	// publish, as comma separated HOST_PORT:GUEST_PORT[/PROTOCOL] entries
+	PortsMetadataKey = "ports"
+
+	// Labels recording a container's published ports and the guest address
+	// they are forwarded to
+	portsLabel        = "io.mistify.ports"
+	portsAddressLabel = "io.mistify.ports.address"
+)
+
+type (
+	// publishedPort is a host port forwarded to a guest port
+	publishedPort struct {
+		hostPort  uint16
+		guestPort uint16
+		protocol  string
+	}
+
+	// iptablesRule is an iptables rule specification, starting with the chain,
+	// in a table
+	iptablesRule struct {
+		table string
+		spec  []string
+		// insert adds the rule at the start of the chain instead of the end
+		insert bool
+	}
+)
+
+// String formats the port the same way it is declared in guest metadata
+func (p publishedPort) String() string {
+	return fmt.Sprintf("%d:%d/%s", p.hostPort, p.guestPort, p.protocol)
+}
+
+// hostKey identifies the host side of the port, which only one guest can use
+func (p publishedPort) hostKey() string {
+	return fmt.Sprintf("%d/%s", p.hostPort, p.protocol)
+}
+
+// parsePort parses a single port number
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		return 0, ErrorValidation{Message: fmt.Sprintf("invalid port %q", value)}
+	}
+	return uint16(port), nil
+}
+
+// parsePublishedPorts parses a list of ports to publish. The protocol
+// defaults to tcp.
+func parsePublishedPorts(value string) ([]publishedPort, error) {
+	var ports []publishedPort
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		port := publishedPort{protocol: "tcp"}
+		if i := strings.Index(entry, "/"); i != -1 {
+			port.protocol = strings.ToLower(entry[i+1:])
+			entry = entry[:i]
+		}
+		if port.protocol != "tcp" && port.protocol != "udp" {
+			return nil, ErrorValidation{Message: fmt.Sprintf("invalid protocol %q", port.protocol)}
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, ErrorValidation{Message: fmt.Sprintf("invalid port mapping %q, expected HOST_PORT:GUEST_PORT", entry)}
+		}
+		var err error
+		if port.hostPort, err = parsePort(parts[0]); err != nil {
+			return nil, err
+		}
+		if port.guestPort, err = parsePort(parts[1]); err != nil {
+			return nil, err
+		}
+		if seen[port.hostKey()] {
+			return nil, ErrorValidation{Message: fmt.Sprintf("host port %s published more than once", port.hostKey())}
+		}
+		seen[port.hostKey()] = true
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// formatPublishedPorts formats ports for a container label
+func formatPublishedPorts(ports []publishedPort) string {
+	entries := make([]string, len(ports))
+	for i, port := range ports {
+		entries[i] = port.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// guestPorts returns the ports a new guest declares in its metadata along with
+// the container labels recording them. Ports are forwarded to the address of
+// the guest's first nic.
+func guestPorts(g *client.Guest) ([]publishedPort, map[string]string, error) {
+	ports, err := parsePublishedPorts(g.Metadata[PortsMetadataKey])
+	if err != nil || len(ports) == 0 {
+		return nil, nil, err
+	}
+	address := g.Nics[0].Address
+	if net.ParseIP(address) == nil {
+		return nil, nil, ErrorValidation{Message: "publishing ports requires an address on the first nic"}
+	}
+	labels := map[string]string{
+		portsLabel:        formatPublishedPorts(ports),
+		portsAddressLabel: address,
+	}
+	return ports, labels, nil
+}
+
+// hostPortInUse checks whether something on the host, such as sshd or the
+// agent itself, is already listening on a host port, by trying to bind it
+func hostPortInUse(port publishedPort) bool {
+	address := net.JoinHostPort("", strconv.Itoa(int(port.hostPort)))
+	var listener io.Closer
+	var err error
+	if port.protocol == "udp" {
+		listener, err = net.ListenPacket("udp", address)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return true
+	}
+	_ = listener.Close()
+	return false
+}
+
+// checkPortConflicts makes sure no other guest has published the same host
+// ports and nothing on the host is listening on them. The caller must hold
+// md.portsMutex until the new container exists.
+func (md *MDocker) checkPortConflicts(ctx context.Context, ports []publishedPort) error {
+	opts := docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": {portsLabel},
+		},
+		Context: ctx,
+	}
+	containers, err := md.client.ListContainers(opts)
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]string)
+	for _, container := range containers {
+		// Anything invalid was rejected when the container was created
+		existing, _ := parsePublishedPorts(container.Labels[portsLabel])
+		for _, port := range existing {
+			inUse[port.hostKey()] = container.ID
+		}
+	}
+	for _, port := range ports {
+		if _, ok := inUse[port.hostKey()]; ok || hostPortInUse(port) {
+			return ErrorAlreadyExists{Kind: "port", ID: port.hostKey()}
+		}
+	}
+	return nil
+}
+
+// containerPorts returns the published ports and guest address recorded on a
+// container
+func (md *MDocker) containerPorts(ctx context.Context, containerID string) ([]publishedPort, string, error) {
+	container, err := md.client.InspectContainerWithContext(containerID, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if container.Config == nil || container.Config.Labels[portsLabel] == "" {
+		return nil, "", nil
+	}
+	ports, err := parsePublishedPorts(container.Config.Labels[portsLabel])
+	if err != nil {
+		return nil, "", err
+	}
+	return ports, container.Config.Labels[portsAddressLabel], nil
+}
+
+// portRules returns the iptables rules forwarding a host port to a guest: a
+// DNAT rule for traffic addressed to the host itself, and a rule accepting the
+// forwarded traffic, which a restrictive FORWARD chain would otherwise drop
+func portRules(guestID, address string, port publishedPort) []iptablesRule {
+	comment := "mistify:" + guestID
+	return []iptablesRule{
+		{
+			table: "nat",
+			spec: []string{
+				"PREROUTING",
+				"-p", port.protocol,
+				"--dport", strconv.Itoa(int(port.hostPort)),
+				"-m", "addrtype", "--dst-type", "LOCAL",
+				"-m", "comment", "--comment", comment,
+				"-j", "DNAT",
+				"--to-destination", net.JoinHostPort(address, strconv.Itoa(int(port.guestPort))),
+			},
+		},
+		{
+			table: "filter",
+			// Inserted so it comes before any rules dropping forwarded traffic
+			insert: true,
+			spec: []string{
+				"FORWARD",
+				"-d", address,
+				"-p", port.protocol,
+				"--dport", strconv.Itoa(int(port.guestPort)),
+				"-m", "conntrack", "--ctstate", "DNAT",
+				"-m", "comment", "--comment", comment,
+				"-j", "ACCEPT",
+			},
+		},
+	}
+}
+
+// exists checks whether the rule is in place
+func (r iptablesRule) exists() bool {
+	// Check fails when the rule doesn't exist
+	return exec.Command("iptables", append([]string{"-t", r.table, "-C"}, r.spec...)...).Run() == nil
+}
+
+// run runs an iptables command for the rule
+func (r iptablesRule) run(ctx context.Context, action string) error {
+	command := "iptables"
+	args := append([]string{"-t", r.table, action}, r.spec...)
+	if output, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+		e := ErrorNetwork{
+			Message: fmt.Sprintf("failed to update port forwarding rule %s", strings.Join(r.spec, " ")),
+			Command: command,
+			Output:  string(output),
+		}
+		logger(ctx).WithFields(log.Fields{
+			"error":   err,
+			"command": command,
+			"args":    args,
+			"output":  string(output),
+		}).Error(e)
+		return e
+	}
+	return nil
+}
+
+// publishPorts adds the rules forwarding a guest's published ports. Rules that
+// already exist are left alone.
+func (md *MDocker) publishPorts(ctx context.Context, guestID string) error {
+	ports, address, err := md.containerPorts(ctx, guestID)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		for _, rule := range portRules(guestID, address, port) {
+			if rule.exists() {
+				continue
+			}
+			action := "-A"
+			if rule.insert {
+				action = "-I"
+			}
+			if err := rule.run(ctx, action); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unpublishPorts removes the rules forwarding a guest's published ports
+func (md *MDocker) unpublishPorts(ctx context.Context, guestID string) error {
+	ports, address, err := md.containerPorts(ctx, guestID)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		for _, rule := range portRules(guestID, address, port) {
+			// Skip rules that are already gone
+			if !rule.exists() {
+				continue
+			}
+			if err := rule.run(ctx, "-D"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package mdocker_test
+
+import (
+	"fmt"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) createGuestWithPorts(ports, address string) (*client.Guest, error) {
+	response := &rpc.GuestResponse{}
+	request := &rpc.GuestRequest{
+		Guest: &client.Guest{
+			ID:     uuid.New(),
+			Image:  s.ImageID,
+			Memory: 10,
+			Nics: []client.Nic{
+				{
+					Name:    "test",
+					Network: s.Bridge,
+					Mac:     "13:7D:DA:F2:ED:63",
+					Address: address,
+				},
+			},
+			Metadata: map[string]string{
+				mdocker.PortsMetadataKey: ports,
+			},
+		},
+	}
+	err := s.Client.Do("MDocker.CreateContainer", request, response)
+	if err == nil {
+		s.ContainerIDs = append(s.ContainerIDs, response.Guest.ID)
+	}
+	return response.Guest, err
+}
+
+func (s *ContainerTestSuite) TestPublishedPorts() {
+	tests := []struct {
+		description string
+		ports       string
+		address     string
+		expectedErr bool
+	}{
+		{"missing guest port",
+			"18080", "10.0.0.2", true},
+		{"invalid port",
+			"18080:asdf", "10.0.0.2", true},
+		{"invalid protocol",
+			"18080:80/sctp", "10.0.0.2", true},
+		{"duplicate host port",
+			"18080:80,18080:81", "10.0.0.2", true},
+		{"missing address",
+			"18080:80", "", true},
+		{"valid",
+			"18080:80,18053:53/udp", "10.0.0.2", false},
+		{"conflict",
+			"18080:8080", "10.0.0.3", true},
+		{"host port in use",
+			fmt.Sprintf("%d:80", s.Port), "10.0.0.3", true},
+		{"same port with another protocol",
+			"18080:80/udp", "10.0.0.3", false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		guest, err := s.createGuestWithPorts(test.ports, test.address)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) {
+			s.Equal(mdocker.GuestStateCreated, guest.State, msg("should be created"))
+		}
+	}
+}
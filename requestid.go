@@ -0,0 +1,98 @@
+package mdocker
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// RequestIDHeader is the header a client can use to supply the
+	// correlation ID of a request. It is returned in every response, and
+	// passed along on the docker and image service calls made for the request.
+	RequestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLength bounds client supplied request IDs, which end up in
+	// every log entry for the request
+	maxRequestIDLength = 128
+)
+
+type (
+	// requestIDKey is the context key for a request's correlation ID
+	requestIDKey struct{}
+
+	// requestIDTransport adds the correlation ID of the request that caused a
+	// docker call to its headers
+	requestIDTransport struct {
+		next http.RoundTripper
+	}
+)
+
+// validRequestID checks that a client supplied request ID is short and
+// printable, so it can't be used to forge log entries or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler tags each request with a correlation ID, taken from the
+// request's header if it has a valid one or generated otherwise, and returns
+// it in the response header
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// withRequestID returns a copy of ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID carried by ctx, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// detachedContext returns a context carrying only the request ID of ctx.
+// Docker calls that change a guest use it so they still run to completion if
+// the client goes away partway through.
+func detachedContext(ctx context.Context) context.Context {
+	if id := requestID(ctx); id != "" {
+		return withRequestID(context.Background(), id)
+	}
+	return context.Background()
+}
+
+// logger returns a log entry tagged with the request ID carried by ctx
+func logger(ctx context.Context) *log.Entry {
+	if id := requestID(ctx); id != "" {
+		return log.WithField("requestID", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// RoundTrip copies the request ID from the request's context to its header
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestID(req.Context()); id != "" {
+		// RoundTrippers must not modify the original request
+		req = req.Clone(req.Context())
+		req.Header.Set(RequestIDHeader, id)
+	}
+	return t.next.RoundTrip(req)
+}
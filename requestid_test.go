@@ -0,0 +1,62 @@
+package mdocker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestRequestID() {
+	body, err := json.Marshal(map[string]interface{}{
+		"method": "MDocker.GetContainer",
+		"params": []interface{}{&rpc.ContainerRequest{ID: uuid.New()}},
+		"id":     0,
+	})
+	s.Require().NoError(err)
+
+	tests := []struct {
+		description string
+		requestID   string
+		expectedID  string
+	}{
+		{"supplied id", "client-request-1", "client-request-1"},
+		{"no id", "", ""},
+		{"invalid id", "bad request id", ""},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, rpc.RPCPath), bytes.NewReader(body))
+		s.Require().NoError(err, msg("failed to create request"))
+		req.Header.Set("Content-Type", "application/json")
+		if test.requestID != "" {
+			req.Header.Set(mdocker.RequestIDHeader, test.requestID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err, msg("request failed"))
+		var response struct {
+			Error *mdocker.RPCError `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		s.Require().NoError(err, msg("failed to decode response"))
+
+		id := resp.Header.Get(mdocker.RequestIDHeader)
+		if test.expectedID != "" {
+			s.Equal(test.expectedID, id, msg("should return the supplied id"))
+		} else {
+			s.NotEmpty(id, msg("should generate an id"))
+			s.NotEqual(test.requestID, id, msg("should not use an invalid id"))
+		}
+		if s.NotNil(response.Error, msg("should fail")) {
+			s.Equal(id, response.Error.Data["requestId"], msg("should include the id in the error"))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package mdocker
+
+import (
+	"fmt"
+
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+type (
+	// ResourceLimits are the defaults and limits applied to new guests. Zero
+	// values mean no default or no limit.
+	ResourceLimits struct {
+		// DefaultMemory is the memory in MB given to guests that don't
+		// request any
+		DefaultMemory uint `yaml:"defaultMemory"`
+		// MaxMemory is the most memory in MB a guest may request
+		MaxMemory uint `yaml:"maxMemory"`
+		// MaxCPU is the most cpus a guest may request
+		MaxCPU uint `yaml:"maxCPU"`
+	}
+)
+
+// Validate checks that the defaults are within the limits
+func (l ResourceLimits) Validate() error {
+	if l.MaxMemory > 0 && l.DefaultMemory > l.MaxMemory {
+		return fmt.Errorf("default memory %dMB exceeds max memory %dMB", l.DefaultMemory, l.MaxMemory)
+	}
+	return nil
+}
+
+// apply fills in defaults for a guest and checks it against the limits
+func (l ResourceLimits) apply(guest *client.Guest) error {
+	if guest.Memory == 0 {
+		guest.Memory = l.DefaultMemory
+	}
+	if l.MaxMemory > 0 && guest.Memory > l.MaxMemory {
+		return ErrorValidation{
+			Message: fmt.Sprintf("memory %dMB exceeds limit of %dMB", guest.Memory, l.MaxMemory),
+		}
+	}
+	if l.MaxCPU > 0 && guest.CPU > l.MaxCPU {
+		return ErrorValidation{
+			Message: fmt.Sprintf("cpu %d exceeds limit of %d", guest.CPU, l.MaxCPU),
+		}
+	}
+	return nil
+}
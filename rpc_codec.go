@@ -0,0 +1,113 @@
+package mdocker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	gorillarpc "github.com/gorilla/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+type (
+	// jsonCodec is the gorilla JSON-RPC codec, except that method errors are
+	// returned as structured RPCError objects rather than strings
+	jsonCodec struct{}
+
+	jsonCodecRequest struct {
+		request   *jsonServerRequest
+		requestID string
+		audit     *auditCall
+		err       error
+	}
+
+	jsonServerRequest struct {
+		Method string           `json:"method"`
+		Params *json.RawMessage `json:"params"`
+		ID     *json.RawMessage `json:"id"`
+	}
+
+	jsonServerResponse struct {
+		Result interface{}      `json:"result"`
+		Error  interface{}      `json:"error"`
+		ID     *json.RawMessage `json:"id"`
+	}
+)
+
+var jsonNull = json.RawMessage("null")
+
+// NewRequest decodes a JSON-RPC request
+func (jsonCodec) NewRequest(r *http.Request) gorillarpc.CodecRequest {
+	request := &jsonServerRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	logx.LogReturnedErr(r.Body.Close, nil, "failed to close request body")
+
+	// Hand the decoded call to the audit log, which records it once the
+	// response has been written
+	audit := auditCallFrom(r.Context())
+	if audit != nil && err == nil {
+		audit.method = request.Method
+		if request.Params != nil {
+			audit.params = *request.Params
+		}
+		audit.err = errNotDispatched
+	}
+	return &jsonCodecRequest{
+		request:   request,
+		requestID: requestID(r.Context()),
+		audit:     audit,
+		err:       err,
+	}
+}
+
+// Method returns the RPC method of the request
+func (c *jsonCodecRequest) Method() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.request.Method, nil
+}
+
+// ReadRequest decodes the request params into the method's request struct
+func (c *jsonCodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.request.Params == nil {
+		c.err = errors.New("rpc: method request ill-formed: missing params field")
+		return c.err
+	}
+	// The params are an array containing the request struct
+	params := [1]interface{}{args}
+	c.err = json.Unmarshal(*c.request.Params, &params)
+	if c.err != nil && c.audit != nil {
+		c.audit.err = c.err
+	}
+	return c.err
+}
+
+// WriteResponse encodes the method's response or error
+func (c *jsonCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.audit != nil {
+		c.audit.err = methodErr
+	}
+	// Notifications don't get a response
+	if c.request.ID == nil {
+		return nil
+	}
+	response := &jsonServerResponse{
+		Result: reply,
+		Error:  &jsonNull,
+		ID:     c.request.ID,
+	}
+	if methodErr != nil {
+		response.Result = &jsonNull
+		response.Error = rpcErrorWithRequestID(newRPCError(methodErr), c.requestID)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	c.err = json.NewEncoder(w).Encode(response)
+	return c.err
+}
@@ -0,0 +1,241 @@
+package mdocker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Error codes returned in RPC error objects. The values are stable so clients
+// can rely on them.
+const (
+	ErrorCodeInternal              ErrorCode = 1
+	ErrorCodeNotFound              ErrorCode = 2
+	ErrorCodeAlreadyExists         ErrorCode = 3
+	ErrorCodeInvalidState          ErrorCode = 4
+	ErrorCodeNetworkFailure        ErrorCode = 5
+	ErrorCodeImageUnavailable      ErrorCode = 6
+	ErrorCodeDependencyUnavailable ErrorCode = 7
+	ErrorCodeValidation            ErrorCode = 8
+	ErrorCodeUnauthorized          ErrorCode = 9
+	ErrorCodePolicyViolation       ErrorCode = 10
+)
+
+type (
+	// ErrorCode identifies a class of RPC error
+	ErrorCode int
+
+	// RPCError is the error object of a JSON-RPC response
+	RPCError struct {
+		Code    ErrorCode              `json:"code"`
+		Message string                 `json:"message"`
+		Data    map[string]interface{} `json:"data,omitempty"`
+	}
+
+	// ErrorValidation should be used for requests that are missing or have
+	// invalid fields
+	ErrorValidation struct {
+		Message string
+	}
+
+	// ErrorInvalidState should be used when a container is not in the state
+	// an operation requires or should have resulted in
+	ErrorInvalidState struct {
+		Expected string
+		Actual   string
+	}
+
+	// ErrorNetwork should be used for failures configuring guest networking
+	ErrorNetwork struct {
+		Message string
+		Command string
+		Output  string
+	}
+
+	// ErrorNotFound should be used when something other than a container,
+	// such as a snapshot, does not exist
+	ErrorNotFound struct {
+		Kind string
+		ID   string
+	}
+
+	// ErrorAlreadyExists should be used when creating something other than a
+	// container, such as a snapshot, that already exists
+	ErrorAlreadyExists struct {
+		Kind string
+		ID   string
+	}
+
+	// ErrorUnauthorized should be used for callers that are not permitted to
+	// make a request
+	ErrorUnauthorized struct {
+		Reason string
+	}
+)
+
+// Error returns a string error message
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// Error returns a string error message
+func (e ErrorValidation) Error() string {
+	return e.Message
+}
+
+// Error returns a string error message
+func (e ErrorInvalidState) Error() string {
+	return fmt.Sprintf("unexpected container state: expected %s, was %s", e.Expected, e.Actual)
+}
+
+// Error returns a string error message
+func (e ErrorNetwork) Error() string {
+	return e.Message
+}
+
+// Error returns a string error message
+func (e ErrorNotFound) Error() string {
+	return fmt.Sprintf("no such %s: %s", e.Kind, e.ID)
+}
+
+// Error returns a string error message
+func (e ErrorAlreadyExists) Error() string {
+	return fmt.Sprintf("%s already exists: %s", e.Kind, e.ID)
+}
+
+// Error returns a string error message
+func (e ErrorUnauthorized) Error() string {
+	return e.Reason
+}
+
+// newRPCError classifies an error returned by an RPC method
+func newRPCError(err error) *RPCError {
+	rpcErr := &RPCError{
+		Code:    ErrorCodeInternal,
+		Message: err.Error(),
+	}
+
+	var (
+		rpcError          *RPCError
+		validation        ErrorValidation
+		invalidState      ErrorInvalidState
+		invalidTransition ErrorInvalidTransition
+		network           ErrorNetwork
+		notFound          ErrorNotFound
+		alreadyExists     ErrorAlreadyExists
+		unauthorized      ErrorUnauthorized
+		policyViolation   ErrorPolicyViolation
+		unavailable       ErrorDockerUnavailable
+		httpCode          ErrorHTTPCode
+		noSuchContainer   *docker.NoSuchContainer
+		alreadyRunning    *docker.ContainerAlreadyRunning
+		notRunning        *docker.ContainerNotRunning
+		dockerError       *docker.Error
+	)
+	switch {
+	case errors.As(err, &rpcError):
+		return rpcError
+	case errors.As(err, &validation):
+		rpcErr.Code = ErrorCodeValidation
+	case errors.As(err, &invalidState):
+		rpcErr.Code = ErrorCodeInvalidState
+		rpcErr.Data = map[string]interface{}{
+			"expected": invalidState.Expected,
+			"actual":   invalidState.Actual,
+		}
+	case errors.As(err, &invalidTransition):
+		rpcErr.Code = ErrorCodeInvalidState
+		rpcErr.Data = map[string]interface{}{
+			"action": invalidTransition.Action,
+			"actual": invalidTransition.State,
+		}
+	case errors.As(err, &network):
+		rpcErr.Code = ErrorCodeNetworkFailure
+		rpcErr.Data = map[string]interface{}{
+			"command": network.Command,
+			"output":  network.Output,
+		}
+	case errors.As(err, &notFound):
+		rpcErr.Code = ErrorCodeNotFound
+		rpcErr.Data = map[string]interface{}{
+			notFound.Kind: notFound.ID,
+		}
+	case errors.As(err, &alreadyExists):
+		rpcErr.Code = ErrorCodeAlreadyExists
+		rpcErr.Data = map[string]interface{}{
+			alreadyExists.Kind: alreadyExists.ID,
+		}
+	case errors.As(err, &unauthorized):
+		rpcErr.Code = ErrorCodeUnauthorized
+	case errors.As(err, &policyViolation):
+		rpcErr.Code = ErrorCodePolicyViolation
+		rpcErr.Data = map[string]interface{}{
+			"setting": policyViolation.Setting,
+			"reason":  policyViolation.Reason,
+		}
+	case errors.As(err, &unavailable):
+		rpcErr.Code = ErrorCodeDependencyUnavailable
+		rpcErr.Data = map[string]interface{}{
+			"dependency": "docker",
+			"since":      unavailable.Since.Format(time.RFC3339),
+		}
+	case errors.As(err, &httpCode):
+		rpcErr.Code = ErrorCodeImageUnavailable
+		rpcErr.Data = map[string]interface{}{
+			"source": httpCode.Source,
+			"status": httpCode.Code,
+		}
+	case errors.Is(err, docker.ErrNoSuchImage):
+		rpcErr.Code = ErrorCodeImageUnavailable
+	case errors.As(err, &noSuchContainer):
+		rpcErr.Code = ErrorCodeNotFound
+		rpcErr.Data = map[string]interface{}{
+			"id": noSuchContainer.ID,
+		}
+	case errors.Is(err, docker.ErrContainerAlreadyExists):
+		rpcErr.Code = ErrorCodeAlreadyExists
+	case errors.As(err, &alreadyRunning):
+		rpcErr.Code = ErrorCodeInvalidState
+		rpcErr.Data = map[string]interface{}{
+			"id":     alreadyRunning.ID,
+			"actual": GuestStateRunning,
+		}
+	case errors.As(err, &notRunning):
+		rpcErr.Code = ErrorCodeInvalidState
+		rpcErr.Data = map[string]interface{}{
+			"id":     notRunning.ID,
+			"actual": GuestStateStopped,
+		}
+	case errors.As(err, &dockerError):
+		switch dockerError.Status {
+		case http.StatusNotFound:
+			rpcErr.Code = ErrorCodeNotFound
+		case http.StatusConflict:
+			// Name conflicts are already covered by ErrContainerAlreadyExists
+			rpcErr.Code = ErrorCodeInvalidState
+		}
+		rpcErr.Data = map[string]interface{}{
+			"status": dockerError.Status,
+		}
+	}
+	return rpcErr
+}
+
+// rpcErrorWithRequestID returns a copy of an RPC error with the request ID added to
+// its data. The copy leaves an RPCError returned by a method unchanged.
+func rpcErrorWithRequestID(rpcErr *RPCError, requestID string) *RPCError {
+	withID := *rpcErr
+	if requestID == "" {
+		return &withID
+	}
+	data := make(map[string]interface{}, len(rpcErr.Data)+1)
+	for key, value := range rpcErr.Data {
+		data[key] = value
+	}
+	data["requestId"] = requestID
+	withID.Data = data
+	return &withID
+}
@@ -0,0 +1,70 @@
+package mdocker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+)
+
+// rpcError makes a raw JSON-RPC call and returns the error object from the
+// response, if any
+func (s *ContainerTestSuite) rpcError(method string, params interface{}) *mdocker.RPCError {
+	body, err := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": []interface{}{params},
+		"id":     0,
+	})
+	s.Require().NoError(err)
+
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", s.Port, rpc.RPCPath), "application/json", bytes.NewReader(body))
+	s.Require().NoError(err)
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	var response struct {
+		Error *mdocker.RPCError `json:"error"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&response))
+	return response.Error
+}
+
+func (s *ContainerTestSuite) TestErrorCodes() {
+	guest := s.createContainer()
+
+	tests := []struct {
+		description  string
+		method       string
+		params       interface{}
+		expectedCode mdocker.ErrorCode
+	}{
+		{"missing guest",
+			"MDocker.StartContainer", &rpc.GuestRequest{}, mdocker.ErrorCodeValidation},
+		{"missing container",
+			"MDocker.GetContainer", &rpc.ContainerRequest{ID: uuid.New()}, mdocker.ErrorCodeNotFound},
+		{"missing image",
+			"MDocker.CreateContainer", &rpc.GuestRequest{Guest: &client.Guest{
+				ID:    uuid.New(),
+				Image: uuid.New(),
+				Nics:  guest.Nics,
+			}}, mdocker.ErrorCodeImageUnavailable},
+		{"existing container",
+			"MDocker.CreateContainer", &rpc.GuestRequest{Guest: guest}, mdocker.ErrorCodeAlreadyExists},
+		{"not running",
+			"MDocker.PauseContainer", &rpc.GuestRequest{Guest: guest}, mdocker.ErrorCodeInvalidState},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		rpcErr := s.rpcError(test.method, test.params)
+		if s.NotNil(rpcErr, msg("should fail")) {
+			s.Equal(test.expectedCode, rpcErr.Code, msg("unexpected error code: %s", rpcErr.Message))
+			s.NotEmpty(rpcErr.Message, msg("should have a message"))
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package mdocker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+// Guest metadata keys that tighten the host security policy for a guest
+const (
+	// CapAddMetadataKey lists capabilities to add, which must already be
+	// added by the policy
+	CapAddMetadataKey = "capAdd"
+	// CapDropMetadataKey lists additional capabilities to drop
+	CapDropMetadataKey = "capDrop"
+	// SeccompMetadataKey and AppArmorMetadataKey may only repeat the
+	// policy's profiles
+	SeccompMetadataKey  = "seccompProfile"
+	AppArmorMetadataKey = "apparmorProfile"
+	// NoNewPrivilegesMetadataKey and ReadOnlyRootfsMetadataKey are booleans
+	NoNewPrivilegesMetadataKey = "noNewPrivileges"
+	ReadOnlyRootfsMetadataKey  = "readOnlyRootfs"
+	// PidsLimitMetadataKey is the most processes the guest may run
+	PidsLimitMetadataKey = "pidsLimit"
+	// UlimitsMetadataKey lists NAME=SOFT[:HARD] ulimits
+	UlimitsMetadataKey = "ulimits"
+)
+
+// seccompUnconfined disables seccomp filtering
+const seccompUnconfined = "unconfined"
+
+type (
+	// SecurityPolicy is the host level security settings applied to every
+	// guest. Guest metadata can tighten it, but not loosen it.
+	SecurityPolicy struct {
+		// CapAdd and CapDrop are capabilities added to and dropped from
+		// docker's defaults
+		CapAdd  []string `yaml:"capAdd"`
+		CapDrop []string `yaml:"capDrop"`
+		// SeccompProfile is the path to a JSON seccomp profile or
+		// "unconfined". Docker's default profile is used if empty.
+		SeccompProfile string `yaml:"seccompProfile"`
+		// AppArmorProfile is the name of a loaded AppArmor profile. Docker's
+		// default profile is used if empty.
+		AppArmorProfile string `yaml:"apparmorProfile"`
+		NoNewPrivileges bool   `yaml:"noNewPrivileges"`
+		ReadOnlyRootfs  bool   `yaml:"readOnlyRootfs"`
+		// PidsLimit is the most processes a guest may run. Zero means no
+		// limit.
+		PidsLimit int64 `yaml:"pidsLimit"`
+		// Ulimits are the highest ulimits a guest may have. Guests may not
+		// set ulimits that aren't listed.
+		Ulimits []Ulimit `yaml:"ulimits"`
+	}
+
+	// Ulimit is a resource limit
+	Ulimit struct {
+		Name string `yaml:"name"`
+		Soft int64  `yaml:"soft"`
+		Hard int64  `yaml:"hard"`
+	}
+
+	// ErrorPolicyViolation should be used for guests that would loosen the
+	// host security policy
+	ErrorPolicyViolation struct {
+		Setting string
+		Reason  string
+	}
+)
+
+// Error returns a string error message
+func (e ErrorPolicyViolation) Error() string {
+	return fmt.Sprintf("host security policy violation: %s: %s", e.Setting, e.Reason)
+}
+
+// normalizeCapability makes capability names comparable, since docker accepts
+// them with or without the CAP_ prefix and in any case
+func normalizeCapability(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "CAP_")
+}
+
+// capabilitySet builds a set of normalized capability names
+func capabilitySet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[normalizeCapability(name)] = true
+	}
+	return set
+}
+
+// splitList splits a comma separated metadata value, skipping empty entries
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Validate checks the policy for conflicting and invalid settings
+func (p SecurityPolicy) Validate() error {
+	drop := capabilitySet(p.CapDrop)
+	for _, name := range p.CapAdd {
+		if normalizeCapability(name) == "" {
+			return fmt.Errorf("invalid capability %q", name)
+		}
+		if drop[normalizeCapability(name)] {
+			return fmt.Errorf("capability %s is both added and dropped", name)
+		}
+	}
+	if p.SeccompProfile != "" && p.SeccompProfile != seccompUnconfined {
+		if _, err := p.seccompProfile(); err != nil {
+			return err
+		}
+	}
+	if p.PidsLimit < 0 {
+		return fmt.Errorf("pids limit must not be negative")
+	}
+	seen := make(map[string]bool, len(p.Ulimits))
+	for _, ulimit := range p.Ulimits {
+		if ulimit.Name == "" {
+			return fmt.Errorf("ulimit missing name")
+		}
+		if seen[ulimit.Name] {
+			return fmt.Errorf("ulimit %s set more than once", ulimit.Name)
+		}
+		seen[ulimit.Name] = true
+		if ulimit.Soft > ulimit.Hard {
+			return fmt.Errorf("ulimit %s soft limit exceeds hard limit", ulimit.Name)
+		}
+	}
+	return nil
+}
+
+// seccompProfile reads the seccomp profile, which docker expects as JSON in
+// the security option rather than as a path
+func (p SecurityPolicy) seccompProfile() (string, error) {
+	data, err := ioutil.ReadFile(p.SeccompProfile)
+	if err != nil {
+		return "", err
+	}
+	if !json.Valid(data) {
+		return "", fmt.Errorf("seccomp profile %s is not valid json", p.SeccompProfile)
+	}
+	return string(data), nil
+}
+
+// parseUlimits parses NAME=SOFT[:HARD] ulimits. The hard limit defaults to the
+// soft limit.
+func parseUlimits(value string) ([]Ulimit, error) {
+	var ulimits []Ulimit
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, ErrorValidation{Message: fmt.Sprintf("invalid ulimit %q, expected NAME=SOFT[:HARD]", entry)}
+		}
+		limits := strings.SplitN(parts[1], ":", 2)
+		soft, err := strconv.ParseInt(limits[0], 10, 64)
+		if err != nil {
+			return nil, ErrorValidation{Message: fmt.Sprintf("invalid ulimit %q", entry)}
+		}
+		hard := soft
+		if len(limits) == 2 {
+			if hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+				return nil, ErrorValidation{Message: fmt.Sprintf("invalid ulimit %q", entry)}
+			}
+		}
+		if soft > hard {
+			return nil, ErrorValidation{Message: fmt.Sprintf("ulimit %s soft limit exceeds hard limit", parts[0])}
+		}
+		ulimits = append(ulimits, Ulimit{Name: parts[0], Soft: soft, Hard: hard})
+	}
+	return ulimits, nil
+}
+
+// parseMetadataBool parses a boolean metadata value
+func parseMetadataBool(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, ErrorValidation{Message: fmt.Sprintf("invalid %s %q", key, value)}
+	}
+	return b, nil
+}
+
+// apply sets a new guest's container security options from the policy,
+// tightened by any security settings in the guest's metadata
+func (p SecurityPolicy) apply(guest *client.Guest, hostConfig *docker.HostConfig) error {
+	metadata := guest.Metadata
+
+	// Capabilities
+	add := capabilitySet(p.CapAdd)
+	drop := capabilitySet(p.CapDrop)
+	for _, name := range splitList(metadata[CapAddMetadataKey]) {
+		if !add[normalizeCapability(name)] {
+			return ErrorPolicyViolation{
+				Setting: CapAddMetadataKey,
+				Reason:  fmt.Sprintf("capability %s is not added by the host policy", name),
+			}
+		}
+	}
+	for _, name := range splitList(metadata[CapDropMetadataKey]) {
+		name = normalizeCapability(name)
+		delete(add, name)
+		drop[name] = true
+	}
+	for name := range add {
+		hostConfig.CapAdd = append(hostConfig.CapAdd, name)
+	}
+	for name := range drop {
+		hostConfig.CapDrop = append(hostConfig.CapDrop, name)
+	}
+	sort.Strings(hostConfig.CapAdd)
+	sort.Strings(hostConfig.CapDrop)
+
+	// Profiles
+	for key, profile := range map[string]string{
+		SeccompMetadataKey:  p.SeccompProfile,
+		AppArmorMetadataKey: p.AppArmorProfile,
+	} {
+		if value, ok := metadata[key]; ok && value != profile {
+			return ErrorPolicyViolation{
+				Setting: key,
+				Reason:  "profile is set by the host policy",
+			}
+		}
+	}
+	switch p.SeccompProfile {
+	case "":
+	case seccompUnconfined:
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+seccompUnconfined)
+	default:
+		// Read the profile each time, so changes apply without a restart
+		profile, err := p.seccompProfile()
+		if err != nil {
+			return err
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+profile)
+	}
+	if p.AppArmorProfile != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor="+p.AppArmorProfile)
+	}
+
+	// Flags that can only be turned on
+	noNewPrivileges := p.NoNewPrivileges
+	readOnlyRootfs := p.ReadOnlyRootfs
+	for key, setting := range map[string]*bool{
+		NoNewPrivilegesMetadataKey: &noNewPrivileges,
+		ReadOnlyRootfsMetadataKey:  &readOnlyRootfs,
+	} {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		b, err := parseMetadataBool(key, value)
+		if err != nil {
+			return err
+		}
+		if *setting && !b {
+			return ErrorPolicyViolation{
+				Setting: key,
+				Reason:  "required by the host policy",
+			}
+		}
+		*setting = b
+	}
+	if noNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+	}
+	hostConfig.ReadonlyRootfs = readOnlyRootfs
+
+	// Pids limit
+	pidsLimit := p.PidsLimit
+	if value, ok := metadata[PidsLimitMetadataKey]; ok {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return ErrorValidation{Message: fmt.Sprintf("invalid %s %q", PidsLimitMetadataKey, value)}
+		}
+		if p.PidsLimit > 0 && limit > p.PidsLimit {
+			return ErrorPolicyViolation{
+				Setting: PidsLimitMetadataKey,
+				Reason:  fmt.Sprintf("%d exceeds the host limit of %d", limit, p.PidsLimit),
+			}
+		}
+		pidsLimit = limit
+	}
+	if pidsLimit > 0 {
+		hostConfig.PidsLimit = &pidsLimit
+	}
+
+	// Ulimits
+	ulimits := make(map[string]Ulimit, len(p.Ulimits))
+	for _, ulimit := range p.Ulimits {
+		ulimits[ulimit.Name] = ulimit
+	}
+	guestUlimits, err := parseUlimits(metadata[UlimitsMetadataKey])
+	if err != nil {
+		return err
+	}
+	for _, ulimit := range guestUlimits {
+		limit, ok := ulimits[ulimit.Name]
+		if !ok {
+			return ErrorPolicyViolation{
+				Setting: UlimitsMetadataKey,
+				Reason:  fmt.Sprintf("ulimit %s is not set by the host policy", ulimit.Name),
+			}
+		}
+		if ulimit.Soft > limit.Soft || ulimit.Hard > limit.Hard {
+			return ErrorPolicyViolation{
+				Setting: UlimitsMetadataKey,
+				Reason:  fmt.Sprintf("ulimit %s exceeds the host limit of %d:%d", ulimit.Name, limit.Soft, limit.Hard),
+			}
+		}
+		ulimits[ulimit.Name] = ulimit
+	}
+	for _, ulimit := range p.Ulimits {
+		// Keep the policy's order
+		limit := ulimits[ulimit.Name]
+		hostConfig.Ulimits = append(hostConfig.Ulimits, docker.ULimit{
+			Name: limit.Name,
+			Soft: limit.Soft,
+			Hard: limit.Hard,
+		})
+	}
+	return nil
+}
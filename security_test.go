@@ -0,0 +1,123 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+)
+
+func (s *ConfigTestSuite) TestSecurityPolicyValidate() {
+	tests := []struct {
+		description string
+		policy      mdocker.SecurityPolicy
+		expectedErr bool
+	}{
+		{"empty",
+			mdocker.SecurityPolicy{}, false},
+		{"capability added and dropped",
+			mdocker.SecurityPolicy{CapAdd: []string{"NET_ADMIN"}, CapDrop: []string{"cap_net_admin"}}, true},
+		{"missing seccomp profile",
+			mdocker.SecurityPolicy{SeccompProfile: "/dev/null/missing"}, true},
+		{"unconfined seccomp",
+			mdocker.SecurityPolicy{SeccompProfile: "unconfined"}, false},
+		{"negative pids limit",
+			mdocker.SecurityPolicy{PidsLimit: -1}, true},
+		{"ulimit soft over hard",
+			mdocker.SecurityPolicy{Ulimits: []mdocker.Ulimit{{Name: "nofile", Soft: 2, Hard: 1}}}, true},
+		{"duplicate ulimit",
+			mdocker.SecurityPolicy{Ulimits: []mdocker.Ulimit{{Name: "nofile"}, {Name: "nofile"}}}, true},
+		{"valid",
+			mdocker.SecurityPolicy{
+				CapDrop:         []string{"NET_RAW"},
+				NoNewPrivileges: true,
+				PidsLimit:       100,
+				Ulimits:         []mdocker.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+			}, false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		if test.expectedErr {
+			s.Error(test.policy.Validate(), msg("should be invalid"))
+		} else {
+			s.NoError(test.policy.Validate(), msg("should be valid"))
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestSecurityPolicy() {
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.Security = mdocker.SecurityPolicy{
+		CapAdd:          []string{"NET_ADMIN"},
+		CapDrop:         []string{"MKNOD"},
+		NoNewPrivileges: true,
+		PidsLimit:       100,
+		Ulimits:         []mdocker.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+	}
+	s.Require().NoError(s.MDocker.Reconfigure(config))
+	defer func() {
+		config.Security = mdocker.SecurityPolicy{}
+		s.NoError(s.MDocker.Reconfigure(config))
+	}()
+
+	nics := []client.Nic{
+		{
+			Name:    "test",
+			Network: s.Bridge,
+			Mac:     "13:7D:DA:F2:ED:63",
+		},
+	}
+
+	tests := []struct {
+		description  string
+		metadata     map[string]string
+		expectedCode mdocker.ErrorCode
+	}{
+		{"policy only",
+			nil, 0},
+		{"tightened",
+			map[string]string{
+				mdocker.CapDropMetadataKey:        "NET_ADMIN,SYS_CHROOT",
+				mdocker.ReadOnlyRootfsMetadataKey: "true",
+				mdocker.PidsLimitMetadataKey:      "50",
+				mdocker.UlimitsMetadataKey:        "nofile=512:1024",
+			}, 0},
+		{"capability not in policy",
+			map[string]string{mdocker.CapAddMetadataKey: "SYS_ADMIN"}, mdocker.ErrorCodePolicyViolation},
+		{"required flag turned off",
+			map[string]string{mdocker.NoNewPrivilegesMetadataKey: "false"}, mdocker.ErrorCodePolicyViolation},
+		{"pids limit raised",
+			map[string]string{mdocker.PidsLimitMetadataKey: "200"}, mdocker.ErrorCodePolicyViolation},
+		{"ulimit raised",
+			map[string]string{mdocker.UlimitsMetadataKey: "nofile=4096"}, mdocker.ErrorCodePolicyViolation},
+		{"ulimit not in policy",
+			map[string]string{mdocker.UlimitsMetadataKey: "nproc=10"}, mdocker.ErrorCodePolicyViolation},
+		{"profile changed",
+			map[string]string{mdocker.SeccompMetadataKey: "unconfined"}, mdocker.ErrorCodePolicyViolation},
+		{"invalid pids limit",
+			map[string]string{mdocker.PidsLimitMetadataKey: "asdf"}, mdocker.ErrorCodeValidation},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		guest := &client.Guest{ID: uuid.New(), Nics: nics, Image: s.ImageID, Metadata: test.metadata}
+		rpcErr := s.rpcError("MDocker.CreateContainer", &rpc.GuestRequest{Guest: guest})
+		if test.expectedCode != 0 {
+			if s.NotNil(rpcErr, msg("should fail")) {
+				s.Equal(test.expectedCode, rpcErr.Code, msg("unexpected error code"))
+			}
+			continue
+		}
+		if !s.Nil(rpcErr, msg("should succeed")) {
+			continue
+		}
+		s.ContainerIDs = append(s.ContainerIDs, guest.ID)
+		container, err := s.Docker.InspectContainer(guest.ID)
+		if s.NoError(err, msg("should create a container")) {
+			s.Contains(container.HostConfig.SecurityOpt, "no-new-privileges", msg("should apply the policy"))
+			s.Contains(container.HostConfig.CapDrop, "MKNOD", msg("should drop the policy's capabilities"))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package mdocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// snapshotRepositoryPrefix prefixes the guest id to form the repository
+	// of a guest's snapshot images, which are tagged with the snapshot name
+	snapshotRepositoryPrefix = "mistify-snapshot/"
+
+	// Labels on snapshot images
+	snapshotGuestLabel   = "io.mistify.snapshot.guest"
+	snapshotNameLabel    = "io.mistify.snapshot.name"
+	snapshotCommentLabel = "io.mistify.snapshot.comment"
+
+	// snapshotNameFormat is used to name snapshots when no name is given
+	snapshotNameFormat = "20060102T150405Z"
+)
+
+// snapshotNamePattern matches valid snapshot names, which are docker tags
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+type (
+	// Snapshot is a point in time copy of a guest's filesystem
+	Snapshot struct {
+		// ID is the id of the snapshot image
+		ID      string    `json:"id"`
+		Guest   string    `json:"guest"`
+		Name    string    `json:"name"`
+		Comment string    `json:"comment"`
+		Created time.Time `json:"created"`
+		// Size is in MB
+		Size uint64 `json:"size"`
+	}
+
+	// SnapshotRequest is a request to act on a guest's snapshots
+	SnapshotRequest struct {
+		// ID is the guest id
+		ID string `json:"id"`
+		// Name is the snapshot name, which must be a valid docker tag. It
+		// defaults to the current time when creating a snapshot.
+		Name    string `json:"name"`
+		Comment string `json:"comment"`
+	}
+
+	// SnapshotResponse is the snapshots affected by or listed in a request
+	SnapshotResponse struct {
+		Snapshots []*Snapshot `json:"snapshots"`
+	}
+)
+
+// snapshotRef returns the image reference for a guest's snapshot
+func snapshotRef(guestID, name string) string {
+	return fmt.Sprintf("%s%s:%s", snapshotRepositoryPrefix, guestID, name)
+}
+
+// validate checks the request has a guest id and, if required, a valid name
+func (r *SnapshotRequest) validate(requireName bool) error {
+	if r.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if r.Name == "" {
+		if requireName {
+			return ErrorValidation{Message: "missing name"}
+		}
+		return nil
+	}
+	if !snapshotNamePattern.MatchString(r.Name) {
+		return ErrorValidation{Message: "invalid snapshot name " + r.Name}
+	}
+	return nil
+}
+
+// snapshotFromImage builds a Snapshot from a snapshot image
+func snapshotFromImage(image *docker.Image) *Snapshot {
+	var labels map[string]string
+	if image.Config != nil {
+		labels = image.Config.Labels
+	}
+	return &Snapshot{
+		ID:      image.ID,
+		Guest:   labels[snapshotGuestLabel],
+		Name:    labels[snapshotNameLabel],
+		Comment: labels[snapshotCommentLabel],
+		Created: image.Created,
+		Size:    uint64(image.Size) / 1024 / 1024,
+	}
+}
+
+// getSnapshot looks up a guest's snapshot by name
+func (md *MDocker) getSnapshot(guestID, name string) (*Snapshot, error) {
+	image, err := md.client.InspectImage(snapshotRef(guestID, name))
+	if errors.Is(err, docker.ErrNoSuchImage) {
+		return nil, ErrorNotFound{Kind: "snapshot", ID: guestID + ":" + name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFromImage(image), nil
+}
+
+// CreateSnapshot commits a guest's container to a new snapshot image
+func (md *MDocker) CreateSnapshot(h *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if err := request.validate(false); err != nil {
+		return err
+	}
+	name := request.Name
+	if name == "" {
+		name = time.Now().UTC().Format(snapshotNameFormat)
+	}
+
+	if _, err := md.getSnapshot(request.ID, name); err == nil {
+		return ErrorAlreadyExists{Kind: "snapshot", ID: request.ID + ":" + name}
+	} else if _, ok := err.(ErrorNotFound); !ok {
+		return err
+	}
+
+	opts := docker.CommitContainerOptions{
+		Container:  request.ID,
+		Repository: snapshotRepositoryPrefix + request.ID,
+		Tag:        name,
+		Message:    request.Comment,
+		Run: &docker.Config{
+			Labels: mergeLabels(managedLabels(kindSnapshot, request.ID, ""), map[string]string{
+				snapshotGuestLabel:   request.ID,
+				snapshotNameLabel:    name,
+				snapshotCommentLabel: request.Comment,
+			}),
+		},
+	}
+	if _, err := md.client.CommitContainer(opts); err != nil {
+		return err
+	}
+
+	// The commit only returns the image id, so look up the rest
+	snapshot, err := md.getSnapshot(request.ID, name)
+	if err != nil {
+		return err
+	}
+	response.Snapshots = []*Snapshot{snapshot}
+	return nil
+}
+
+// ListSnapshots lists a guest's snapshots, oldest first
+func (md *MDocker) ListSnapshots(h *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if err := request.validate(false); err != nil {
+		return err
+	}
+
+	opts := docker.ListImagesOptions{
+		Filters: map[string][]string{
+			"label": {snapshotGuestLabel + "=" + request.ID},
+		},
+	}
+	images, err := md.client.ListImages(opts)
+	if err != nil {
+		return err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(images))
+	for _, image := range images {
+		snapshots = append(snapshots, &Snapshot{
+			ID:      image.ID,
+			Guest:   image.Labels[snapshotGuestLabel],
+			Name:    image.Labels[snapshotNameLabel],
+			Comment: image.Labels[snapshotCommentLabel],
+			Created: time.Unix(image.Created, 0),
+			Size:    uint64(image.Size) / 1024 / 1024,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+
+	response.Snapshots = snapshots
+	return nil
+}
+
+// DeleteSnapshot deletes a guest's snapshot
+func (md *MDocker) DeleteSnapshot(h *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if err := request.validate(true); err != nil {
+		return err
+	}
+	snapshot, err := md.getSnapshot(request.ID, request.Name)
+	if err != nil {
+		return err
+	}
+	if err := md.client.RemoveImage(snapshotRef(request.ID, request.Name)); err != nil {
+		return err
+	}
+
+	response.Snapshots = []*Snapshot{snapshot}
+	return nil
+}
+
+// rollbackBackupName returns the name a guest's container is moved to while
+// it is replaced by a rollback
+func rollbackBackupName(guestID string) string {
+	return guestID + "-rollback"
+}
+
+// recoverRollback cleans up after a rollback of a guest that was interrupted,
+// e.g. by the agent dying. If the replacement container was created, the
+// container it replaced is removed; otherwise the original is moved back.
+func (md *MDocker) recoverRollback(ctx context.Context, guestID string) error {
+	backupName := rollbackBackupName(guestID)
+	backup, err := md.client.InspectContainerWithContext(backupName, ctx)
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return nil
+		}
+		return err
+	}
+
+	_, err = md.client.InspectContainerWithContext(guestID, ctx)
+	if err == nil {
+		logger(ctx).WithFields(log.Fields{
+			"guest":     guestID,
+			"container": backup.ID,
+		}).Warning("removing container left behind by an interrupted rollback")
+		return md.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:      backup.ID,
+			Context: ctx,
+		})
+	}
+	if _, ok := err.(*docker.NoSuchContainer); !ok {
+		return err
+	}
+	logger(ctx).WithFields(log.Fields{
+		"guest":     guestID,
+		"container": backup.ID,
+	}).Warning("restoring container moved aside by an interrupted rollback")
+	return md.client.RenameContainer(docker.RenameContainerOptions{
+		ID:      backup.ID,
+		Name:    guestID,
+		Context: ctx,
+	})
+}
+
+// RollbackSnapshot replaces a stopped guest's container with one created from
+// a snapshot. The new container keeps the guest id and the old container's
+// configuration, including its hostname and MAC address, so the guest's nics
+// are attached as before when it is started.
+func (md *MDocker) RollbackSnapshot(h *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if err := request.validate(true); err != nil {
+		return err
+	}
+	snapshot, err := md.getSnapshot(request.ID, request.Name)
+	if err != nil {
+		return err
+	}
+
+	ctx := detachedContext(h.Context())
+	if err := md.recoverRollback(ctx, request.ID); err != nil {
+		return err
+	}
+
+	container, err := md.client.InspectContainerWithContext(request.ID, ctx)
+	if err != nil {
+		return err
+	}
+	state := guestState(container.State)
+	if !stateIn(state, transitionDelete.from) {
+		return ErrorInvalidTransition{
+			Action: "roll back",
+			State:  state,
+		}
+	}
+
+	// Move the current container aside rather than removing it, so it can be
+	// restored if the new one can't be created
+	renameOpts := docker.RenameContainerOptions{
+		ID:      container.ID,
+		Name:    rollbackBackupName(request.ID),
+		Context: ctx,
+	}
+	if err := md.client.RenameContainer(renameOpts); err != nil {
+		return err
+	}
+	logger(ctx).WithFields(log.Fields{
+		"guest":     request.ID,
+		"container": container.ID,
+		"snapshot":  request.Name,
+	}).Info("moved container aside for rollback")
+
+	config := *container.Config
+	config.Image = snapshotRef(request.ID, request.Name)
+	createOpts := docker.CreateContainerOptions{
+		Name:       request.ID,
+		Config:     &config,
+		HostConfig: container.HostConfig,
+		Context:    ctx,
+	}
+	if _, err := md.client.CreateContainer(createOpts); err != nil {
+		renameOpts.Name = request.ID
+		if renameErr := md.client.RenameContainer(renameOpts); renameErr != nil {
+			logger(ctx).WithFields(log.Fields{
+				"error":     renameErr,
+				"guest":     request.ID,
+				"container": container.ID,
+			}).Error("failed to restore container after failed rollback")
+		}
+		return err
+	}
+
+	removeOpts := docker.RemoveContainerOptions{
+		ID:      container.ID,
+		Context: ctx,
+	}
+	if err := md.client.RemoveContainer(removeOpts); err != nil {
+		// The rollback itself succeeded, so just leave the old container.
+		// The next rollback of the guest removes it.
+		logger(ctx).WithFields(log.Fields{
+			"error":     err,
+			"guest":     request.ID,
+			"container": container.ID,
+		}).Error("failed to remove container replaced by rollback")
+	}
+
+	response.Snapshots = []*Snapshot{snapshot}
+	return nil
+}
@@ -0,0 +1,139 @@
+package mdocker_test
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func (s *ContainerTestSuite) snapshotAction(action string, request *mdocker.SnapshotRequest) ([]*mdocker.Snapshot, error) {
+	response := &mdocker.SnapshotResponse{}
+	err := s.Client.Do("MDocker."+action, request, response)
+	return response.Snapshots, err
+}
+
+func (s *ContainerTestSuite) deleteSnapshots(guest *client.Guest) {
+	snapshots, _ := s.snapshotAction("ListSnapshots", &mdocker.SnapshotRequest{ID: guest.ID})
+	for _, snapshot := range snapshots {
+		_, _ = s.snapshotAction("DeleteSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: snapshot.Name})
+	}
+}
+
+func (s *ContainerTestSuite) TestCreateSnapshot() {
+	guest := s.createContainer()
+	defer s.deleteSnapshots(guest)
+
+	tests := []struct {
+		description string
+		request     *mdocker.SnapshotRequest
+		expectedErr bool
+	}{
+		{"missing id",
+			&mdocker.SnapshotRequest{}, true},
+		{"invalid name",
+			&mdocker.SnapshotRequest{ID: guest.ID, Name: "-foo"}, true},
+		{"invalid id",
+			&mdocker.SnapshotRequest{ID: "asdf", Name: "foo"}, true},
+		{"default name",
+			&mdocker.SnapshotRequest{ID: guest.ID}, false},
+		{"named",
+			&mdocker.SnapshotRequest{ID: guest.ID, Name: "foo", Comment: "bar"}, false},
+		{"duplicate name",
+			&mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"}, true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		snapshots, err := s.snapshotAction("CreateSnapshot", test.request)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) && s.Len(snapshots, 1, msg("should return the snapshot")) {
+			s.Equal(guest.ID, snapshots[0].Guest, msg("should be labeled with the guest"))
+			s.NotEmpty(snapshots[0].Name, msg("should have a name"))
+			s.Equal(test.request.Comment, snapshots[0].Comment, msg("should have the comment"))
+		}
+	}
+
+	snapshots, err := s.snapshotAction("ListSnapshots", &mdocker.SnapshotRequest{ID: guest.ID})
+	s.NoError(err)
+	s.Len(snapshots, 2, "should list the guest's snapshots")
+}
+
+func (s *ContainerTestSuite) TestDeleteSnapshot() {
+	guest := s.createContainer()
+	defer s.deleteSnapshots(guest)
+	_, err := s.snapshotAction("CreateSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.Require().NoError(err)
+
+	_, err = s.snapshotAction("DeleteSnapshot", &mdocker.SnapshotRequest{ID: guest.ID})
+	s.Error(err, "should require a name")
+	_, err = s.snapshotAction("DeleteSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "bar"})
+	s.Error(err, "should fail for a missing snapshot")
+	_, err = s.snapshotAction("DeleteSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.NoError(err)
+
+	snapshots, err := s.snapshotAction("ListSnapshots", &mdocker.SnapshotRequest{ID: guest.ID})
+	s.NoError(err)
+	s.Empty(snapshots, "should no longer list the snapshot")
+}
+
+func (s *ContainerTestSuite) TestRollbackSnapshot() {
+	guest := s.createContainer()
+	defer s.deleteSnapshots(guest)
+	_, err := s.snapshotAction("CreateSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.Require().NoError(err)
+
+	_, err = s.containerAction("StartContainer", guest)
+	s.Require().NoError(err)
+	_, err = s.snapshotAction("RollbackSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.Error(err, "should not roll back a running guest")
+
+	_, err = s.containerAction("StopContainer", guest)
+	s.Require().NoError(err)
+	_, err = s.snapshotAction("RollbackSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "bar"})
+	s.Error(err, "should fail for a missing snapshot")
+	_, err = s.snapshotAction("RollbackSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.NoError(err)
+
+	response := &rpc.ContainerResponse{}
+	s.Require().NoError(s.Client.Do("MDocker.GetContainer", &rpc.ContainerRequest{ID: guest.ID}, response))
+	container := response.Containers[0]
+	s.Equal("mistify-snapshot/"+guest.ID+":foo", container.Config.Image, "should use the snapshot image")
+	s.Equal(guest.Nics[0].Mac, container.Config.MacAddress, "should keep the mac address")
+	s.Equal(guest.ID, container.Config.Hostname, "should keep the hostname")
+
+	// Make sure the replaced container is gone before deleting snapshots
+	_, err = s.Docker.InspectContainer(guest.ID + "-rollback")
+	s.Error(err, "should remove the replaced container")
+	_, err = s.containerAction("DeleteContainer", guest)
+	s.NoError(err)
+}
+
+func (s *ContainerTestSuite) TestRollbackSnapshotInterrupted() {
+	guest := s.createContainer()
+	defer s.deleteSnapshots(guest)
+	_, err := s.snapshotAction("CreateSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.Require().NoError(err)
+
+	// Leave the guest's container moved aside, as a rollback that died
+	// before creating the replacement would
+	original, err := s.Docker.InspectContainer(guest.ID)
+	s.Require().NoError(err)
+	s.Require().NoError(s.Docker.RenameContainer(docker.RenameContainerOptions{
+		ID:   original.ID,
+		Name: guest.ID + "-rollback",
+	}))
+
+	_, err = s.snapshotAction("RollbackSnapshot", &mdocker.SnapshotRequest{ID: guest.ID, Name: "foo"})
+	s.NoError(err, "should recover and roll back")
+
+	_, err = s.Docker.InspectContainer(guest.ID)
+	s.NoError(err, "should have the guest's container")
+	_, err = s.Docker.InspectContainer(guest.ID + "-rollback")
+	s.Error(err, "should not leave the moved container behind")
+	_, err = s.containerAction("DeleteContainer", guest)
+	s.NoError(err)
+}
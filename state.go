@@ -0,0 +1,211 @@
+package mdocker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Guest states
+const (
+	GuestStateCreated = "created"
+	GuestStateRunning = "running"
+	GuestStatePaused  = "paused"
+	GuestStateStopped = "stopped"
+	GuestStateDeleted = "deleted"
+	GuestStateError   = "error"
+)
+
+const (
+	// guestStateTimeout is how long to wait for docker to reach the target
+	// state of a transition
+	guestStateTimeout = 10 * time.Second
+	// guestStatePollInterval is how often the state is checked while waiting
+	guestStatePollInterval = 100 * time.Millisecond
+)
+
+type (
+	// guestTransition is a change of guest state requested by an RPC method
+	guestTransition struct {
+		action string
+		// from are the states the transition may start from
+		from []string
+		// to are the states that complete the transition
+		to []string
+	}
+
+	// ErrorInvalidTransition should be used when a guest can't make a
+	// requested transition from its current state
+	ErrorInvalidTransition struct {
+		Action string
+		State  string
+	}
+
+	// ContainerStateRequest is a request for the state of a container,
+	// optionally waiting for it to reach a state
+	ContainerStateRequest struct {
+		ID string `json:"id"`
+		// State, when set, is waited for before responding
+		State string `json:"state"`
+		// Timeout is the number of seconds to wait for State
+		Timeout uint `json:"timeout"`
+	}
+
+	// ContainerStateResponse is the current state of a container
+	ContainerStateResponse struct {
+		State string `json:"state"`
+	}
+)
+
+var (
+	transitionStart = guestTransition{
+		action: "start",
+		// Starting a running guest is allowed so interfaces can be recreated
+		from: []string{GuestStateCreated, GuestStateStopped, GuestStateError, GuestStateRunning},
+		to:   []string{GuestStateRunning},
+	}
+	transitionStop = guestTransition{
+		action: "stop",
+		from:   []string{GuestStateRunning, GuestStatePaused, GuestStateStopped, GuestStateCreated, GuestStateError},
+		to:     []string{GuestStateStopped, GuestStateCreated, GuestStateError},
+	}
+	transitionPause = guestTransition{
+		action: "pause",
+		from:   []string{GuestStateRunning},
+		to:     []string{GuestStatePaused},
+	}
+	transitionUnpause = guestTransition{
+		action: "unpause",
+		from:   []string{GuestStatePaused},
+		to:     []string{GuestStateRunning},
+	}
+	transitionDelete = guestTransition{
+		action: "delete",
+		from:   []string{GuestStateCreated, GuestStateStopped, GuestStateError},
+		to:     []string{GuestStateDeleted},
+	}
+)
+
+// Error returns a string error message
+func (e ErrorInvalidTransition) Error() string {
+	return fmt.Sprintf("cannot %s guest in state %s", e.Action, e.State)
+}
+
+// guestState maps a docker container state to a guest state
+func guestState(state docker.State) string {
+	switch {
+	case state.Paused:
+		return GuestStatePaused
+	case state.Running:
+		return GuestStateRunning
+	case state.Dead, state.Error != "":
+		return GuestStateError
+	case state.StartedAt.IsZero():
+		return GuestStateCreated
+	default:
+		return GuestStateStopped
+	}
+}
+
+// stateIn returns whether a state is one of a list of states
+func stateIn(state string, states []string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionGuest validates that a guest may make a transition from its
+// current state, runs the action, and waits for docker to reach one of the
+// transition's final states, returning it
+func (md *MDocker) transitionGuest(ctx context.Context, containerID string, transition guestTransition, action func() error) (string, error) {
+	state, err := md.fetchContainerState(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	if !stateIn(state, transition.from) {
+		return "", ErrorInvalidTransition{
+			Action: transition.action,
+			State:  state,
+		}
+	}
+
+	if err := action(); err != nil {
+		return "", err
+	}
+
+	return md.waitForState(ctx, containerID, transition.to, guestStateTimeout)
+}
+
+// waitForState polls the state of a container until it is one of the
+// expected states or the timeout passes. It stops early if the context is
+// done or the MDocker is closed.
+func (md *MDocker) waitForState(ctx context.Context, containerID string, expected []string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(guestStatePollInterval)
+	defer ticker.Stop()
+	for {
+		state, err := md.fetchContainerState(ctx, containerID)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); !ok || !stateIn(GuestStateDeleted, expected) {
+				return "", err
+			}
+			state = GuestStateDeleted
+		}
+		if stateIn(state, expected) {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			return "", ErrorInvalidState{
+				Expected: expected[0],
+				Actual:   state,
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-md.supervisor.stop:
+			return "", errClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetContainerState returns the state of a container. If a state is given,
+// it waits up to the timeout for the container to reach it first.
+func (md *MDocker) GetContainerState(h *http.Request, request *ContainerStateRequest, response *ContainerStateResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	expected := []string{request.State}
+	switch request.State {
+	case GuestStateCreated, GuestStateRunning, GuestStatePaused, GuestStateStopped, GuestStateDeleted, GuestStateError:
+	case "":
+		// Any state will do
+		expected = []string{
+			GuestStateCreated,
+			GuestStateRunning,
+			GuestStatePaused,
+			GuestStateStopped,
+			GuestStateError,
+		}
+	default:
+		return ErrorValidation{Message: "unknown state " + request.State}
+	}
+	timeout := time.Duration(request.Timeout) * time.Second
+	if request.Timeout == 0 {
+		timeout = guestStateTimeout
+	}
+
+	state, err := md.waitForState(h.Context(), request.ID, expected, timeout)
+	if err != nil {
+		return err
+	}
+	response.State = state
+	return nil
+}
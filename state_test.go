@@ -0,0 +1,92 @@
+package mdocker_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/pborman/uuid"
+)
+
+func (s *ContainerTestSuite) TestInvalidTransitions() {
+	guest := s.createContainer()
+	s.Equal(mdocker.GuestStateCreated, guest.State, "new containers should be created")
+
+	tests := []struct {
+		description string
+		action      string
+		before      []string
+	}{
+		{"pause created", "PauseContainer", nil},
+		{"unpause running", "UnpauseContainer", []string{"StartContainer"}},
+		{"delete running", "DeleteContainer", []string{"StartContainer"}},
+		{"pause stopped", "PauseContainer", []string{"StopContainer"}},
+		{"start paused", "StartContainer", []string{"StartContainer", "PauseContainer"}},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		for _, action := range test.before {
+			_, err := s.containerAction(action, guest)
+			s.Require().NoError(err, msg("setup action %s should succeed", action))
+		}
+		_, err := s.containerAction(test.action, guest)
+		s.Error(err, msg("should fail"))
+		// Reset to a known state
+		_, _ = s.containerAction("UnpauseContainer", guest)
+		_, _ = s.containerAction("StopContainer", guest)
+	}
+}
+
+func (s *ContainerTestSuite) TestGetContainerState() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	tests := []struct {
+		description   string
+		request       *mdocker.ContainerStateRequest
+		expectedState string
+		expectedErr   bool
+	}{
+		{"missing id",
+			&mdocker.ContainerStateRequest{}, "", true},
+		{"invalid id",
+			&mdocker.ContainerStateRequest{ID: uuid.New()}, "", true},
+		{"unknown state",
+			&mdocker.ContainerStateRequest{ID: guest.ID, State: "asdf"}, "", true},
+		{"current state",
+			&mdocker.ContainerStateRequest{ID: guest.ID}, mdocker.GuestStateRunning, false},
+		{"reached state",
+			&mdocker.ContainerStateRequest{ID: guest.ID, State: mdocker.GuestStateRunning}, mdocker.GuestStateRunning, false},
+		{"unreached state",
+			&mdocker.ContainerStateRequest{ID: guest.ID, State: mdocker.GuestStatePaused, Timeout: 1}, "", true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &mdocker.ContainerStateResponse{}
+		err := s.Client.Do("MDocker.GetContainerState", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) {
+			s.Equal(test.expectedState, response.State, msg("unexpected state"))
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestGetContainerStateCancelled() {
+	guest := s.createContainer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/", nil).WithContext(ctx)
+	request := &mdocker.ContainerStateRequest{ID: guest.ID, State: mdocker.GuestStatePaused, Timeout: 30}
+
+	start := time.Now()
+	err := s.MDocker.GetContainerState(req, request, &mdocker.ContainerStateResponse{})
+	s.Error(err, "should fail when the request is cancelled")
+	s.True(time.Since(start) < 5*time.Second, "should stop waiting when the request is cancelled")
+}
@@ -0,0 +1,126 @@
+package mdocker
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// statsTimeout bounds how long to wait for docker to produce a stats sample
+const statsTimeout = 10 * time.Second
+
+type (
+	// NicStats contains traffic counters for a guest network interface, taken
+	// from its OVS port
+	NicStats struct {
+		Name      string `json:"name"`
+		Port      string `json:"port"`
+		RxBytes   uint64 `json:"rxBytes"`
+		RxPackets uint64 `json:"rxPackets"`
+		RxErrors  uint64 `json:"rxErrors"`
+		RxDropped uint64 `json:"rxDropped"`
+		TxBytes   uint64 `json:"txBytes"`
+		TxPackets uint64 `json:"txPackets"`
+		TxErrors  uint64 `json:"txErrors"`
+		TxDropped uint64 `json:"txDropped"`
+	}
+
+	// ContainerStatsResponse contains a resource usage sample for a container
+	ContainerStatsResponse struct {
+		Read        time.Time   `json:"read"`
+		CPUPercent  float64     `json:"cpuPercent"`
+		MemoryUsage uint64      `json:"memoryUsage"`
+		MemoryLimit uint64      `json:"memoryLimit"`
+		BlockRead   uint64      `json:"blockRead"`
+		BlockWrite  uint64      `json:"blockWrite"`
+		Nics        []*NicStats `json:"nics"`
+	}
+)
+
+// cpuPercent computes CPU usage as a percentage of a single CPU from the
+// difference between the current and previous samples, the same way the
+// docker cli does
+func cpuPercent(stats *docker.Stats) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuDelta / systemDelta * cpus * 100
+}
+
+// blockIO sums the bytes read and written across all block devices
+func blockIO(stats *docker.Stats) (uint64, uint64) {
+	var read, write uint64
+	for _, entry := range stats.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += entry.Value
+		case "write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
+// GetContainerStats takes a one-shot resource usage sample of a Docker
+// container. Network counters come from the guest's OVS ports, since the
+// containers have no docker-managed networking.
+func (md *MDocker) GetContainerStats(h *http.Request, request *rpc.ContainerRequest, response *ContainerStatsResponse) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+
+	container, err := md.client.InspectContainerWithContext(request.ID, h.Context())
+	if err != nil {
+		return err
+	}
+
+	if err := md.checkDocker(); err != nil {
+		return err
+	}
+	statsChan := make(chan *docker.Stats, 1)
+	errChan := make(chan error, 1)
+	go func(start time.Time) {
+		errChan <- md.client.Stats(docker.StatsOptions{
+			ID:      container.ID,
+			Stats:   statsChan,
+			Stream:  false,
+			Timeout: statsTimeout,
+		})
+		observeDockerStream(h.Context(), http.MethodGet, "/containers/{id}/stats", start)
+	}(time.Now())
+	// The channel is closed by the docker client when it is done
+	var stats *docker.Stats
+	for s := range statsChan {
+		stats = s
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+	if stats == nil {
+		return errors.New("no stats returned")
+	}
+
+	nics, err := md.network.interfaceStatistics(h.Context(), strings.TrimPrefix(container.Name, "/"))
+	if err != nil {
+		return err
+	}
+
+	response.Read = stats.Read
+	response.CPUPercent = cpuPercent(stats)
+	response.MemoryUsage = stats.MemoryStats.Usage
+	response.MemoryLimit = stats.MemoryStats.Limit
+	response.BlockRead, response.BlockWrite = blockIO(stats)
+	response.Nics = nics
+	return nil
+}
@@ -0,0 +1,42 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func (s *ContainerTestSuite) TestGetContainerStats() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	tests := []struct {
+		description string
+		ID          string
+		expectedErr bool
+	}{
+		{"missing id", "", true},
+		{"bad id", "asdf", true},
+		{"valid id", guest.ID, false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		request := &rpc.ContainerRequest{
+			ID: test.ID,
+		}
+		response := &mdocker.ContainerStatsResponse{}
+
+		err := s.Client.Do("MDocker.GetContainerStats", request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+		} else {
+			s.NoError(err, msg("should succeed"))
+			s.NotZero(response.MemoryUsage, msg("should report memory usage"))
+			s.Equal(uint64(10*1024*1024), response.MemoryLimit, msg("should report memory limit"))
+			if s.Len(response.Nics, len(guest.Nics), msg("should report each nic")) {
+				s.Equal(guest.Nics[0].Name, response.Nics[0].Name, msg("should report nic name"))
+				s.NotEmpty(response.Nics[0].Port, msg("should report ovs port"))
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package mdocker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// How often the docker connection is checked while it is up
+	supervisorPingInterval = 5 * time.Second
+	// Bounds of the backoff between reconnection attempts while it is down
+	supervisorMinBackoff = 1 * time.Second
+	supervisorMaxBackoff = 30 * time.Second
+	// How long a single ping may take before the daemon is considered gone
+	supervisorPingTimeout = 5 * time.Second
+)
+
+// errClosed is returned by waits cut short because the MDocker was closed
+var errClosed = errors.New("mdocker is closed")
+
+type (
+	// dockerSupervisor watches the connection to the docker daemon, tracking
+	// whether it is available and restoring event listeners after the daemon
+	// comes back
+	dockerSupervisor struct {
+		client    *docker.Client
+		mutex     sync.RWMutex
+		available bool
+		lostAt    time.Time
+		listeners map[chan *docker.APIEvents]struct{}
+		stop      chan struct{}
+		stopOnce  sync.Once
+	}
+
+	// availabilityTransport fails docker calls immediately while the daemon
+	// is unavailable instead of letting them hang
+	availabilityTransport struct {
+		next       http.RoundTripper
+		supervisor *dockerSupervisor
+	}
+
+	// supervisorBypassKey marks a request context as coming from the
+	// supervisor itself, so its pings reach the daemon while it is down
+	supervisorBypassKey struct{}
+)
+
+func newDockerSupervisor(client *docker.Client) *dockerSupervisor {
+	return &dockerSupervisor{
+		client:    client,
+		available: true,
+		listeners: make(map[chan *docker.APIEvents]struct{}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// RoundTrip passes the request along if docker is available
+func (t *availabilityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if bypass, _ := req.Context().Value(supervisorBypassKey{}).(bool); !bypass {
+		if err := t.supervisor.check(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// check returns an ErrorDockerUnavailable if docker is currently unavailable
+func (s *dockerSupervisor) check() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !s.available {
+		return ErrorDockerUnavailable{Since: s.lostAt}
+	}
+	return nil
+}
+
+// checkDocker returns an ErrorDockerUnavailable if docker is currently
+// unavailable. Streaming and hijacked docker calls, such as logs, stats,
+// exports, image loads, events, exec and attach, dial docker directly instead
+// of going through the client's transport, so they have to check first.
+func (md *MDocker) checkDocker() error {
+	return md.supervisor.check()
+}
+
+// ping checks the connection to docker, regardless of its known state
+func (s *dockerSupervisor) ping(ctx context.Context) error {
+	ctx = context.WithValue(ctx, supervisorBypassKey{}, true)
+	return s.client.PingWithContext(ctx)
+}
+
+// run checks the connection until stopped, backing off between attempts to
+// reconnect while docker is unavailable
+func (s *dockerSupervisor) run() {
+	backoff := supervisorMinBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), supervisorPingTimeout)
+		err := s.ping(ctx)
+		cancel()
+
+		interval := supervisorPingInterval
+		available := s.check() == nil
+		switch {
+		case err == nil && !available:
+			s.reconnected()
+			backoff = supervisorMinBackoff
+		case err != nil && available:
+			s.lost(err)
+			interval = backoff
+		case err != nil:
+			log.WithField("error", err).Debug("docker still unavailable")
+			backoff *= 2
+			if backoff > supervisorMaxBackoff {
+				backoff = supervisorMaxBackoff
+			}
+			interval = backoff
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lost marks docker as unavailable
+func (s *dockerSupervisor) lost(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.available = false
+	s.lostAt = time.Now()
+	log.WithField("error", err).Error("lost connection to docker")
+}
+
+// reconnected marks docker as available again and resubscribes event
+// listeners, whose event stream was cut when the daemon went away
+func (s *dockerSupervisor) reconnected() {
+	s.mutex.Lock()
+	s.available = true
+	downtime := time.Since(s.lostAt)
+	listeners := make([]chan *docker.APIEvents, 0, len(s.listeners))
+	for listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	s.mutex.Unlock()
+
+	log.WithField("downtime", downtime.String()).Info("reconnected to docker")
+
+	// The lock can't be held here, since resubscribing makes docker calls
+	for _, listener := range listeners {
+		// The client may or may not have already given up on the listener
+		_ = s.client.RemoveEventListener(listener)
+		if err := s.client.AddEventListener(listener); err != nil {
+			log.WithField("error", err).Error("failed to resubscribe docker event listener")
+		}
+	}
+}
+
+// addEventListener subscribes a listener to docker events and keeps it
+// subscribed across reconnections
+func (s *dockerSupervisor) addEventListener(listener chan *docker.APIEvents) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if err := s.client.AddEventListener(listener); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners[listener] = struct{}{}
+	return nil
+}
+
+// removeEventListener unsubscribes a listener from docker events
+func (s *dockerSupervisor) removeEventListener(listener chan *docker.APIEvents) error {
+	s.mutex.Lock()
+	delete(s.listeners, listener)
+	s.mutex.Unlock()
+	return s.client.RemoveEventListener(listener)
+}
+
+// close stops the supervisor
+func (s *dockerSupervisor) close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// AddEventListener subscribes a channel to docker events. The subscription is
+// restored automatically if the docker daemon restarts.
+func (md *MDocker) AddEventListener(listener chan *docker.APIEvents) error {
+	return md.supervisor.addEventListener(listener)
+}
+
+// RemoveEventListener unsubscribes a channel from docker events
+func (md *MDocker) RemoveEventListener(listener chan *docker.APIEvents) error {
+	return md.supervisor.removeEventListener(listener)
+}
+
+// Close stops the MDocker's background docker connection monitoring,
+// cancels any running jobs, waiting a short time for them to clean up, and
+// closes the audit log
+func (md *MDocker) Close() {
+	md.supervisor.close()
+	ctx, cancel := context.WithTimeout(context.Background(), jobStopTimeout)
+	defer cancel()
+	if err := md.jobs.cancelAll(ctx); err != nil {
+		log.WithField("error", err).Error("timed out waiting for cancelled jobs")
+	}
+	if md.audit != nil {
+		if err := md.audit.close(); err != nil {
+			log.WithField("error", err).Error("failed to close audit log")
+		}
+	}
+}
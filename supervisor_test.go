@@ -0,0 +1,134 @@
+package mdocker_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mistifyio/mistify-agent-docker"
+)
+
+type dockerProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+// newDockerProxy forwards connections on a unix socket to the docker daemon,
+// so a test can cut docker off from an MDocker
+func newDockerProxy(path string) (*dockerProxy, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	p := &dockerProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("unix", "/var/run/docker.sock")
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			p.mutex.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mutex.Unlock()
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			go func() { _, _ = io.Copy(conn, upstream) }()
+		}
+	}()
+	return p, nil
+}
+
+// close stops accepting connections and cuts the open ones
+func (p *dockerProxy) close() {
+	_ = p.listener.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *ContainerTestSuite) TestEventListener() {
+	listener := make(chan *docker.APIEvents, 10)
+	s.NoError(s.MDocker.AddEventListener(listener))
+	defer func() {
+		s.NoError(s.MDocker.RemoveEventListener(listener))
+	}()
+
+	guest := s.createContainer()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-listener:
+			if event.Actor.Attributes["name"] == guest.ID {
+				return
+			}
+		case <-timeout:
+			s.Fail("should receive an event for the new container")
+			return
+		}
+	}
+}
+
+func (s *ContainerTestSuite) TestDockerUnavailable() {
+	dir, err := ioutil.TempDir("", "mdocker-proxy")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socket := filepath.Join(dir, "docker.sock")
+	proxy, err := newDockerProxy(socket)
+	s.Require().NoError(err)
+	md, err := mdocker.New("unix://"+socket, s.ImageService, "")
+	s.Require().NoError(err)
+	defer md.Close()
+
+	proxy.close()
+
+	// Wait for the supervisor to notice
+	var unavailable mdocker.ErrorDockerUnavailable
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		err := md.GetInfo(nil, &struct{}{}, &docker.DockerInfo{})
+		if errors.As(err, &unavailable) {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.FailNow("docker should be unavailable", "last error: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Streaming calls dial docker directly, so check they fail fast too
+	h := httptest.NewRequest("POST", "/", nil)
+	tests := []struct {
+		description string
+		call        func() error
+	}{
+		{"logs", func() error {
+			return md.GetContainerLogs(h, &mdocker.LogsRequest{ID: "foo"}, &mdocker.LogsResponse{})
+		}},
+		{"events", func() error {
+			return md.AddEventListener(make(chan *docker.APIEvents))
+		}},
+	}
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		start := time.Now()
+		err := test.call()
+		s.True(errors.As(err, &unavailable), msg("should be unavailable, was %v", err))
+		s.True(time.Since(start) < time.Second, msg("should fail fast"))
+	}
+}
@@ -0,0 +1,157 @@
+package mdocker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type (
+	// TLSConfig configures TLS for the RPC server
+	TLSConfig struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+		// ClientCAFile enables mutual TLS when set. Clients must present a
+		// certificate signed by one of the CAs it contains.
+		ClientCAFile string `yaml:"clientCAFile"`
+	}
+
+	// certReloader serves the configured certificate and client CAs,
+	// reloading them when the files change on disk
+	certReloader struct {
+		config    TLSConfig
+		mutex     sync.Mutex
+		cert      *tls.Certificate
+		clientCAs *x509.CertPool
+		modTimes  map[string]time.Time
+	}
+)
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls requires both a cert and key file")
+	}
+	r := &certReloader{
+		config: config,
+	}
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the paths of all configured files
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+// fileModTimes returns the current modification time of each file
+func (r *certReloader) fileModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load reads the certificate and client CAs from disk
+func (r *certReloader) load(modTimes map[string]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.config.ClientCAFile)
+		}
+	}
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// reloadIfChanged reloads the files if any of them have changed. Failures
+// are logged and the previously loaded files stay in use, so a partially
+// written update doesn't take the server down.
+func (r *certReloader) reloadIfChanged() {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		log.WithField("error", err).Error("failed to check tls files")
+		return
+	}
+
+	changed := false
+	for file, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := r.load(modTimes); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"files": r.files(),
+		}).Error("failed to reload tls files")
+		return
+	}
+	log.WithField("files", r.files()).Info("reloaded tls files")
+}
+
+// getConfigForClient builds the tls config for each new connection from the
+// current files
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reloadIfChanged()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = r.clientCAs
+	}
+	return config, nil
+}
+
+// tlsConfig returns a server tls config backed by the reloader
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
@@ -0,0 +1,219 @@
+package mdocker_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-docker"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type TLSTestSuite struct {
+	APITestSuite
+	TLSPort    int
+	TLSServer  *graceful.Server
+	Dir        string
+	CA         *x509.Certificate
+	CAKey      *ecdsa.PrivateKey
+	ClientCert tls.Certificate
+}
+
+func TestTLSTestSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}
+
+func (s *TLSTestSuite) SetupSuite() {
+	s.APITestSuite.SetupSuite()
+
+	var err error
+	s.Dir, err = ioutil.TempDir("", "mdocker-tls")
+	s.Require().NoError(err)
+
+	// Self-signed CA used for both the server and client certs
+	s.CAKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &s.CAKey.PublicKey, s.CAKey)
+	s.Require().NoError(err)
+	s.CA, err = x509.ParseCertificate(caDER)
+	s.Require().NoError(err)
+	s.writePEM("ca.pem", "CERTIFICATE", caDER)
+
+	s.writeCert("server", "server-1", x509.ExtKeyUsageServerAuth)
+	s.writeCert("client", "client", x509.ExtKeyUsageClientAuth)
+	s.ClientCert, err = tls.LoadX509KeyPair(filepath.Join(s.Dir, "client.pem"), filepath.Join(s.Dir, "client-key.pem"))
+	s.Require().NoError(err)
+
+	s.TLSPort = s.Port + 1
+	s.TLSServer, err = s.MDocker.RunHTTPWithConfig(mdocker.HTTPConfig{
+		Port: uint(s.TLSPort),
+		TLS: &mdocker.TLSConfig{
+			CertFile:     filepath.Join(s.Dir, "server.pem"),
+			KeyFile:      filepath.Join(s.Dir, "server-key.pem"),
+			ClientCAFile: filepath.Join(s.Dir, "ca.pem"),
+		},
+	})
+	s.Require().NoError(err)
+	time.Sleep(200 * time.Millisecond)
+}
+
+func (s *TLSTestSuite) TearDownSuite() {
+	stopChan := s.TLSServer.StopChan()
+	s.TLSServer.Stop(5 * time.Second)
+	<-stopChan
+
+	s.APITestSuite.TearDownSuite()
+	_ = os.RemoveAll(s.Dir)
+}
+
+func (s *TLSTestSuite) writePEM(name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(s.Dir, name), data, 0600))
+}
+
+func (s *TLSTestSuite) writeCert(name, commonName string, usage x509.ExtKeyUsage) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.CA, &key.PublicKey, s.CAKey)
+	s.Require().NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	s.Require().NoError(err)
+	s.writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	s.writePEM(name+".pem", "CERTIFICATE", der)
+}
+
+func (s *TLSTestSuite) get(clientCerts []tls.Certificate) (*http.Response, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.CA)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: clientCerts,
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	return client.Get(fmt.Sprintf("https://127.0.0.1:%d%s", s.TLSPort, mdocker.HealthPath))
+}
+
+func (s *TLSTestSuite) TestClientCert() {
+	_, err := s.get(nil)
+	s.Error(err, "should reject clients without a certificate")
+
+	resp, err := s.get([]tls.Certificate{s.ClientCert})
+	if s.NoError(err, "should accept clients with a valid certificate") {
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	}
+}
+
+func (s *TLSTestSuite) TestReload() {
+	resp, err := s.get([]tls.Certificate{s.ClientCert})
+	if !s.NoError(err) {
+		return
+	}
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	s.Equal("server-1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// Make sure the modification time changes
+	time.Sleep(10 * time.Millisecond)
+	s.writeCert("server", "server-2", x509.ExtKeyUsageServerAuth)
+
+	resp, err = s.get([]tls.Certificate{s.ClientCert})
+	if !s.NoError(err) {
+		return
+	}
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	s.Equal("server-2", resp.TLS.PeerCertificates[0].Subject.CommonName, "should serve the new certificate")
+}
+
+func (s *TLSTestSuite) TestAuditClientCert() {
+	config := mdocker.DefaultConfig()
+	config.ImageService = s.ImageService
+	config.Audit.Path = filepath.Join(s.Dir, "audit.log")
+	md, err := mdocker.NewWithConfig(config)
+	s.Require().NoError(err)
+	defer md.Close()
+
+	port := s.Port + 6
+	server, err := md.RunHTTPWithConfig(mdocker.HTTPConfig{
+		Port: uint(port),
+		TLS: &mdocker.TLSConfig{
+			CertFile:     filepath.Join(s.Dir, "server.pem"),
+			KeyFile:      filepath.Join(s.Dir, "server-key.pem"),
+			ClientCAFile: filepath.Join(s.Dir, "ca.pem"),
+		},
+	})
+	s.Require().NoError(err)
+	defer func() {
+		stopChan := server.StopChan()
+		server.Stop(5 * time.Second)
+		<-stopChan
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"method": "MDocker.DeleteContainer",
+		"params": []interface{}{&rpc.ContainerRequest{ID: uuid.New()}},
+		"id":     0,
+	})
+	s.Require().NoError(err)
+	pool := x509.NewCertPool()
+	pool.AddCert(s.CA)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{s.ClientCert},
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Post(fmt.Sprintf("https://127.0.0.1:%d%s", port, rpc.RPCPath), "application/json", bytes.NewReader(body))
+	s.Require().NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	data, err := ioutil.ReadFile(config.Audit.Path)
+	s.Require().NoError(err)
+	entry := &mdocker.AuditEntry{}
+	s.Require().NoError(json.Unmarshal(data, entry))
+	s.Equal("MDocker.DeleteContainer", entry.Method)
+	s.Equal("client", entry.Caller, "should identify the caller by its certificate")
+}
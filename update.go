@@ -0,0 +1,206 @@
+package mdocker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// defaultCPUPeriod is the cfs period docker uses when only a quota is set
+	defaultCPUPeriod = 100000
+
+	minBlkioWeight = 10
+	maxBlkioWeight = 1000
+)
+
+type (
+	// UpdateRequest is a request to change a container's resources. Zero
+	// values leave a setting unchanged.
+	UpdateRequest struct {
+		ID string `json:"id"`
+		// Memory is in MB
+		Memory uint `json:"memory"`
+		// CPUShares is the container's cpu weight relative to others
+		CPUShares uint `json:"cpuShares"`
+		// CPUPeriod and CPUQuota are the cfs period and quota in
+		// microseconds. The quota divided by the period is the number of cpus
+		// the container may use.
+		CPUPeriod uint `json:"cpuPeriod"`
+		CPUQuota  uint `json:"cpuQuota"`
+		// CpusetCpus and CpusetMems restrict the container to cpus and memory
+		// nodes, e.g. "0-2,4"
+		CpusetCpus string `json:"cpusetCpus"`
+		CpusetMems string `json:"cpusetMems"`
+		// BlkioWeight is the container's block io weight, from 10 to 1000
+		BlkioWeight uint `json:"blkioWeight"`
+	}
+
+	// UpdateResponse is the container's resulting host configuration
+	UpdateResponse struct {
+		HostConfig *docker.HostConfig `json:"hostConfig"`
+	}
+)
+
+// numaNodesPath lists the host's online NUMA nodes in cpuset format
+const numaNodesPath = "/sys/devices/system/node/online"
+
+// parseCPUSet parses a cpuset list like "0-2,4" into the set of cpus or
+// memory nodes it contains. Each one must be less than count, which is
+// checked before ranges are expanded.
+func parseCPUSet(set, kind string, count int) (map[int]bool, error) {
+	members := make(map[int]bool)
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset %q", set)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpuset %q", set)
+			}
+		}
+		if last >= count {
+			return nil, fmt.Errorf("%s %d does not exist on host with %d %ss", kind, last, count, kind)
+		}
+		for member := first; member <= last; member++ {
+			members[member] = true
+		}
+	}
+	return members, nil
+}
+
+// hostNUMANodes returns the number of NUMA nodes on the host. Hosts without
+// NUMA support have a single node.
+func hostNUMANodes() (int, error) {
+	data, err := ioutil.ReadFile(numaNodesPath)
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Nodes are numbered from zero, so the highest is one less than the count
+	online := strings.TrimSpace(string(data))
+	last := online[strings.LastIndexAny(online, ",-")+1:]
+	highest, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, fmt.Errorf("invalid online nodes %q", online)
+	}
+	return highest + 1, nil
+}
+
+// validateUpdate checks an update request against the host's capacity and
+// the configured resource limits
+func (md *MDocker) validateUpdate(request *UpdateRequest) error {
+	if request.ID == "" {
+		return ErrorValidation{Message: "missing id"}
+	}
+	if request.BlkioWeight != 0 && (request.BlkioWeight < minBlkioWeight || request.BlkioWeight > maxBlkioWeight) {
+		return ErrorValidation{
+			Message: fmt.Sprintf("blkio weight must be between %d and %d", minBlkioWeight, maxBlkioWeight),
+		}
+	}
+	if request.CPUPeriod != 0 && request.CPUQuota == 0 {
+		return ErrorValidation{Message: "cpu period requires a cpu quota"}
+	}
+
+	info, err := md.client.Info()
+	if err != nil {
+		return err
+	}
+	limits := md.getResourceLimits()
+
+	if request.Memory != 0 {
+		if memory := int64(request.Memory) * 1024 * 1024; memory > info.MemTotal {
+			return ErrorValidation{
+				Message: fmt.Sprintf("memory %dMB exceeds host memory of %dMB", request.Memory, info.MemTotal/1024/1024),
+			}
+		}
+		if limits.MaxMemory > 0 && request.Memory > limits.MaxMemory {
+			return ErrorValidation{
+				Message: fmt.Sprintf("memory %dMB exceeds limit of %dMB", request.Memory, limits.MaxMemory),
+			}
+		}
+	}
+
+	if request.CPUQuota != 0 {
+		period := request.CPUPeriod
+		if period == 0 {
+			period = defaultCPUPeriod
+		}
+		cpus := float64(request.CPUQuota) / float64(period)
+		if cpus > float64(info.NCPU) {
+			return ErrorValidation{
+				Message: fmt.Sprintf("cpu quota of %.2f cpus exceeds host cpus of %d", cpus, info.NCPU),
+			}
+		}
+		if limits.MaxCPU > 0 && cpus > float64(limits.MaxCPU) {
+			return ErrorValidation{
+				Message: fmt.Sprintf("cpu quota of %.2f cpus exceeds limit of %d", cpus, limits.MaxCPU),
+			}
+		}
+	}
+
+	if request.CpusetCpus != "" {
+		cpus, err := parseCPUSet(request.CpusetCpus, "cpu", info.NCPU)
+		if err != nil {
+			return ErrorValidation{Message: err.Error()}
+		}
+		if limits.MaxCPU > 0 && len(cpus) > int(limits.MaxCPU) {
+			return ErrorValidation{
+				Message: fmt.Sprintf("cpuset of %d cpus exceeds limit of %d", len(cpus), limits.MaxCPU),
+			}
+		}
+	}
+	if request.CpusetMems != "" {
+		nodes, err := hostNUMANodes()
+		if err != nil {
+			return err
+		}
+		if _, err := parseCPUSet(request.CpusetMems, "memory node", nodes); err != nil {
+			return ErrorValidation{Message: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// UpdateContainer changes the resources of a container without restarting it
+func (md *MDocker) UpdateContainer(h *http.Request, request *UpdateRequest, response *UpdateResponse) error {
+	if err := md.validateUpdate(request); err != nil {
+		return err
+	}
+
+	opts := docker.UpdateContainerOptions{
+		Memory:      int(request.Memory) * 1024 * 1024,
+		CPUShares:   int(request.CPUShares),
+		CPUPeriod:   int(request.CPUPeriod),
+		CPUQuota:    int(request.CPUQuota),
+		CpusetCpus:  request.CpusetCpus,
+		CpusetMems:  request.CpusetMems,
+		BlkioWeight: int(request.BlkioWeight),
+	}
+	if opts.Memory != 0 {
+		// Docker rejects memory above the current swap limit, so keep swap
+		// at twice memory, the same as when the container was created
+		opts.MemorySwap = 2 * opts.Memory
+	}
+	if err := md.client.UpdateContainer(request.ID, opts); err != nil {
+		return err
+	}
+
+	container, err := md.client.InspectContainer(request.ID)
+	if err != nil {
+		return err
+	}
+	response.HostConfig = container.HostConfig
+	return nil
+}
@@ -0,0 +1,53 @@
+package mdocker_test
+
+import (
+	"github.com/mistifyio/mistify-agent-docker"
+)
+
+func (s *ContainerTestSuite) TestUpdateContainer() {
+	guest := s.createContainer()
+	_, _ = s.containerAction("StartContainer", guest)
+
+	tests := []struct {
+		description string
+		request     *mdocker.UpdateRequest
+		expectedErr bool
+	}{
+		{"missing id",
+			&mdocker.UpdateRequest{}, true},
+		{"invalid id",
+			&mdocker.UpdateRequest{ID: "asdf", Memory: 20}, true},
+		{"too much memory",
+			&mdocker.UpdateRequest{ID: guest.ID, Memory: 1 << 30}, true},
+		{"too many cpus",
+			&mdocker.UpdateRequest{ID: guest.ID, CPUQuota: 1 << 30}, true},
+		{"missing cpu",
+			&mdocker.UpdateRequest{ID: guest.ID, CpusetCpus: "100000"}, true},
+		{"invalid cpuset",
+			&mdocker.UpdateRequest{ID: guest.ID, CpusetCpus: "a-b"}, true},
+		{"huge cpuset range",
+			&mdocker.UpdateRequest{ID: guest.ID, CpusetCpus: "0-2147483647"}, true},
+		{"missing memory node",
+			&mdocker.UpdateRequest{ID: guest.ID, CpusetMems: "0-100000"}, true},
+		{"invalid blkio weight",
+			&mdocker.UpdateRequest{ID: guest.ID, BlkioWeight: 1}, true},
+		{"valid request",
+			&mdocker.UpdateRequest{ID: guest.ID, Memory: 20, CPUShares: 512, CPUQuota: 50000, CpusetCpus: "0"}, false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &mdocker.UpdateResponse{}
+		err := s.Client.Do("MDocker.UpdateContainer", test.request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should fail"))
+			continue
+		}
+		if s.NoError(err, msg("should succeed")) && s.NotNil(response.HostConfig, msg("should return the host config")) {
+			s.EqualValues(20*1024*1024, response.HostConfig.Memory, msg("should apply memory"))
+			s.EqualValues(512, response.HostConfig.CPUShares, msg("should apply cpu shares"))
+			s.EqualValues(50000, response.HostConfig.CPUQuota, msg("should apply cpu quota"))
+			s.Equal("0", response.HostConfig.CPUSetCPUs, msg("should apply cpuset"))
+		}
+	}
+}